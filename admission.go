@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// admitFunc handles an admission request independently of the
+// AdmissionReview version the API server used to send it.
+type admitFunc func(*admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse
+
+// reviewRequest decodes an AdmissionReview of any supported version and returns
+// its request converted to admission.k8s.io/v1 together with a function that
+// wraps a v1 response back into a review of the original version.
+func reviewRequest(body []byte) (*admissionv1.AdmissionRequest, func(*admissionv1.AdmissionResponse) runtime.Object, error) {
+	obj, gvk, err := deserializer.Decode(body, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch ar := obj.(type) {
+	case *admissionv1.AdmissionReview:
+		encode := func(resp *admissionv1.AdmissionResponse) runtime.Object {
+			review := &admissionv1.AdmissionReview{Response: resp}
+			review.SetGroupVersionKind(*gvk)
+			return review
+		}
+		return ar.Request, encode, nil
+	case *v1beta1.AdmissionReview:
+		encode := func(resp *admissionv1.AdmissionResponse) runtime.Object {
+			review := &v1beta1.AdmissionReview{Response: convertAdmissionResponseToV1beta1(resp)}
+			review.SetGroupVersionKind(*gvk)
+			return review
+		}
+		return convertAdmissionRequestToV1(ar.Request), encode, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported group version kind: %v", gvk)
+	}
+}
+
+func convertAdmissionRequestToV1(r *v1beta1.AdmissionRequest) *admissionv1.AdmissionRequest {
+	if r == nil {
+		return nil
+	}
+	return &admissionv1.AdmissionRequest{
+		UID:                r.UID,
+		Kind:               r.Kind,
+		Resource:           r.Resource,
+		SubResource:        r.SubResource,
+		RequestKind:        r.RequestKind,
+		RequestResource:    r.RequestResource,
+		RequestSubResource: r.RequestSubResource,
+		Name:               r.Name,
+		Namespace:          r.Namespace,
+		Operation:          admissionv1.Operation(r.Operation),
+		UserInfo:           r.UserInfo,
+		Object:             r.Object,
+		OldObject:          r.OldObject,
+		DryRun:             r.DryRun,
+		Options:            r.Options,
+	}
+}
+
+func convertAdmissionResponseToV1beta1(r *admissionv1.AdmissionResponse) *v1beta1.AdmissionResponse {
+	if r == nil {
+		return nil
+	}
+	var patchType *v1beta1.PatchType
+	if r.PatchType != nil {
+		pt := v1beta1.PatchType(*r.PatchType)
+		patchType = &pt
+	}
+	return &v1beta1.AdmissionResponse{
+		UID:              r.UID,
+		Allowed:          r.Allowed,
+		Result:           r.Result,
+		Patch:            r.Patch,
+		PatchType:        patchType,
+		AuditAnnotations: r.AuditAnnotations,
+		Warnings:         r.Warnings,
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+)
+
+// defaultCELCostLimit bounds the total cost of the CEL rules evaluated for a
+// single admission request.
+const defaultCELCostLimit = 1000000
+
+// newCELEnv declares the variables available to CEL rules: object is the
+// admitted object decoded from JSON.
+func newCELEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("object", cel.DynType),
+		cel.CrossTypeNumericComparisons(true),
+	)
+}
+
+// compileCEL type-checks expression and prepares it for evaluation with the
+// given cost limit.
+func compileCEL(env *cel.Env, expression string, costLimit uint64) (cel.Program, error) {
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if t := ast.OutputType(); t != cel.BoolType && t != cel.DynType {
+		return nil, fmt.Errorf("expression must evaluate to bool, not %v", t)
+	}
+	return env.Program(ast, cel.CostLimit(costLimit))
+}
+
+// evalCEL runs program against obj and returns whether it evaluated to true.
+func evalCEL(program cel.Program, obj interface{}) (bool, error) {
+	val, _, err := program.Eval(map[string]interface{}{"object": obj})
+	if err != nil {
+		return false, err
+	}
+	result, ok := val.(types.Bool)
+	if !ok {
+		return false, fmt.Errorf("expression evaluated to %v, not bool", val.Type())
+	}
+	return bool(result), nil
+}
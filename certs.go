@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// certWatcher keeps the most recent valid x509 key pair loaded from certFile
+// and keyFile and hands it out through GetCertificate.
+type certWatcher struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newCertWatcher loads the initial key pair and fails if it is not valid.
+func newCertWatcher(certFile, keyFile string) (*certWatcher, error) {
+	cw := &certWatcher{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := cw.reload(); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// reload reads the key pair from disk and swaps it in if it parses. On error
+// the previously loaded pair stays in service.
+func (cw *certWatcher) reload() error {
+	certPEM, err := ioutil.ReadFile(cw.certFile)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := ioutil.ReadFile(cw.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cw.mu.RLock()
+	unchanged := bytes.Equal(certPEM, cw.certPEM) && bytes.Equal(keyPEM, cw.keyPEM)
+	cw.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+
+	cw.mu.Lock()
+	cw.cert, cw.certPEM, cw.keyPEM = &pair, certPEM, keyPEM
+	cw.mu.Unlock()
+	glog.Infof("Loaded key pair from %s and %s", cw.certFile, cw.keyFile)
+	return nil
+}
+
+// Watch reloads the key pair whenever the certificate or key file changes.
+func (cw *certWatcher) Watch(stop <-chan struct{}) error {
+	return watchFiles([]string{cw.certFile, cw.keyFile}, stop, func() {
+		if err := cw.reload(); err != nil {
+			glog.Errorf("Failed to reload key pair, keeping the previous one: %v", err)
+		}
+	})
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (cw *certWatcher) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cw.mu.RLock()
+	defer cw.mu.RUnlock()
+	return cw.cert, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeKeyPair(t *testing.T, certFile, keyFile, cn string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func servedCN(t *testing.T, cw *certWatcher) string {
+	t.Helper()
+	cert, err := cw.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertWatcherReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	if _, err := newCertWatcher(certFile, keyFile); err == nil {
+		t.Fatal("expected error without a key pair")
+	}
+
+	writeKeyPair(t, certFile, keyFile, "first")
+	cw, err := newCertWatcher(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeKeyPair(t, certFile, keyFile, "second")
+	if err := cw.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if cn := servedCN(t, cw); cn != "second" {
+		t.Errorf("expected rotated certificate, got %s", cn)
+	}
+
+	if err := ioutil.WriteFile(certFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.reload(); err == nil {
+		t.Error("expected error for a corrupt certificate")
+	}
+	if cn := servedCN(t, cw); cn != "second" {
+		t.Errorf("expected last good certificate, got %s", cn)
+	}
+}
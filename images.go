@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/distribution/reference"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// imagePolicyRule is the rule name reported for image policy violations.
+const imagePolicyRule = "images"
+
+// ImagePolicy restricts where container images come from and how they are
+// referenced. Namespaces override the rules for objects in a namespace, field
+// by field.
+type ImagePolicy struct {
+	ImageRules `json:",inline"`
+	Namespaces map[string]ImageRules `json:"namespaces,omitempty"`
+}
+
+// ImageRules are the checks applied to every container image.
+type ImageRules struct {
+	// AllowedRegistries are patterns such as socp.io/* or
+	// docker.io/library/nginx matched against the registry and repository of
+	// an image. Any registry is allowed if empty.
+	AllowedRegistries []string `json:"allowedRegistries,omitempty"`
+	// AllowLatest permits untagged images and the latest tag
+	AllowLatest *bool `json:"allowLatest,omitempty"`
+	// RequireDigest requires images to be pinned by digest
+	RequireDigest *bool `json:"requireDigest,omitempty"`
+	// Mode of the image checks, the namespace mode of the policy or enforce if
+	// empty
+	Mode PolicyMode `json:"mode,omitempty"`
+}
+
+// containerImage is the image of a container together with the path of the
+// image field.
+type containerImage struct {
+	container string
+	image     string
+	path      *field.Path
+	// validated is set when Validation already reports malformed references
+	validated bool
+}
+
+// rules merges the overrides of namespace into the default rules.
+func (ip *ImagePolicy) rules(namespace string) ImageRules {
+	rules := ip.ImageRules
+	override, ok := ip.Namespaces[namespace]
+	if !ok {
+		return rules
+	}
+	if len(override.AllowedRegistries) != 0 {
+		rules.AllowedRegistries = override.AllowedRegistries
+	}
+	if override.AllowLatest != nil {
+		rules.AllowLatest = override.AllowLatest
+	}
+	if override.RequireDigest != nil {
+		rules.RequireDigest = override.RequireDigest
+	}
+	if override.Mode != "" {
+		rules.Mode = override.Mode
+	}
+	return rules
+}
+
+func (ip *ImagePolicy) validate() error {
+	if err := validateImageRules(&ip.ImageRules); err != nil {
+		return err
+	}
+	for namespace, rules := range ip.Namespaces {
+		if err := validateImageRules(&rules); err != nil {
+			return fmt.Errorf("namespace %q: %v", namespace, err)
+		}
+	}
+	return nil
+}
+
+func validateImageRules(rules *ImageRules) error {
+	for _, pattern := range rules.AllowedRegistries {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("allowedRegistries %q: %v", pattern, err)
+		}
+	}
+	return validateMode(rules.Mode)
+}
+
+// check returns why image breaks the rules, or nil.
+func (rules *ImageRules) check(image containerImage) *field.Error {
+	if image.image == "" {
+		return nil
+	}
+	named, err := reference.ParseNormalizedNamed(image.image)
+	if err != nil && image.validated {
+		return nil
+	}
+	if err != nil {
+		return field.Invalid(image.path, image.image, fmt.Sprintf("container %q has an invalid image reference: %v", image.container, err))
+	}
+	repository := named.Name()
+	if len(rules.AllowedRegistries) != 0 && !matchesRegistry(rules.AllowedRegistries, repository) {
+		return field.Forbidden(image.path, fmt.Sprintf("container %q uses image %s from %s, allowed registries are %s",
+			image.container, image.image, repository, strings.Join(rules.AllowedRegistries, ", ")))
+	}
+	_, digested := named.(reference.Digested)
+	if rules.RequireDigest != nil && *rules.RequireDigest && !digested {
+		return field.Forbidden(image.path, fmt.Sprintf("container %q must pin image %s by digest", image.container, image.image))
+	}
+	if rules.AllowLatest == nil || !*rules.AllowLatest {
+		tagged, ok := named.(reference.Tagged)
+		switch {
+		case !ok && !digested:
+			return field.Forbidden(image.path, fmt.Sprintf("container %q must use a tagged image, not %s", image.container, image.image))
+		case ok && tagged.Tag() == "latest":
+			return field.Forbidden(image.path, fmt.Sprintf("container %q cannot use the latest tag of %s", image.container, repository))
+		}
+	}
+	return nil
+}
+
+// matchesRegistry reports whether repository, such as socp.io/zk/sidecar,
+// matches one of patterns. A pattern ending in /* matches every repository
+// below it.
+func matchesRegistry(patterns []string, repository string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(repository, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+		if ok, _ := path.Match(pattern, repository); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// EvaluateImages checks images against the image policy for namespace.
+func (p *Policy) EvaluateImages(namespace string, images []containerImage) []PolicyViolation {
+	var violations []PolicyViolation
+	if p == nil || p.Images == nil {
+		return violations
+	}
+	rules := p.Images.rules(namespace)
+	mode := p.sectionMode(rules.Mode, namespace)
+	for _, image := range images {
+		if err := rules.check(image); err != nil {
+			violations = append(violations, PolicyViolation{Rule: imagePolicyRule, Mode: mode, Err: err})
+		}
+	}
+	return violations
+}
+
+func applicationImages(app *Application) []containerImage {
+	var images []containerImage
+	componentsPath := field.NewPath("spec", "components")
+	for i, com := range app.Spec.Components {
+		for j, con := range com.Containers {
+			images = append(images, containerImage{
+				container: con.Name,
+				image:     con.Image,
+				path:      componentsPath.Index(i).Child("containers").Index(j).Child("image"),
+				validated: true,
+			})
+		}
+	}
+	return images
+}
+
+func podSpecImages(spec *corev1.PodSpec, fldPath *field.Path) []containerImage {
+	var images []containerImage
+	for i, c := range spec.InitContainers {
+		images = append(images, containerImage{container: c.Name, image: c.Image, path: fldPath.Child("initContainers").Index(i).Child("image")})
+	}
+	for i, c := range spec.Containers {
+		images = append(images, containerImage{container: c.Name, image: c.Image, path: fldPath.Child("containers").Index(i).Child("image")})
+	}
+	for i, c := range spec.EphemeralContainers {
+		images = append(images, containerImage{container: c.Name, image: c.Image, path: fldPath.Child("ephemeralContainers").Index(i).Child("image")})
+	}
+	return images
+}
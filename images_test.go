@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestEvaluateImages(t *testing.T) {
+	const rules = `
+images:
+  allowedRegistries: ["socp.io/*", "docker.io/library/nginx"]
+  namespaces:
+    prod:
+      requireDigest: true
+    sandbox:
+      allowLatest: true
+      mode: warn
+`
+	var policy Policy
+	if err := yaml.Unmarshal([]byte(rules), &policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	digest := "@sha256:" + strings.Repeat("a", 64)
+	for _, tc := range []struct {
+		namespace string
+		image     string
+		mode      PolicyMode
+		detail    string
+	}{
+		{"default", "socp.io/zk/sidecar:0407", "", ""},
+		{"default", "nginx:1.19", "", ""},
+		{"default", "socp.io/zk/sidecar" + digest, "", ""},
+		{"default", "socp.io.evil.com/zk/sidecar:0407", PolicyModeEnforce, "allowed registries"},
+		{"default", "busybox:1.36", PolicyModeEnforce, "allowed registries"},
+		{"default", "socp.io/zk/sidecar", PolicyModeEnforce, "tagged image"},
+		{"default", "socp.io/zk/sidecar:latest", PolicyModeEnforce, "latest tag"},
+		{"default", "socp.io/Zk/sidecar:0407", PolicyModeEnforce, "invalid image reference"},
+		{"prod", "socp.io/zk/sidecar:0407", PolicyModeEnforce, "by digest"},
+		{"prod", "socp.io/zk/sidecar:0407" + digest, "", ""},
+		{"sandbox", "socp.io/zk/sidecar:latest", "", ""},
+		{"sandbox", "busybox:1.36", PolicyModeWarn, "allowed registries"},
+	} {
+		images := []containerImage{{container: "app", image: tc.image, path: field.NewPath("spec", "containers").Index(0).Child("image")}}
+		violations := policy.EvaluateImages(tc.namespace, images)
+		if tc.detail == "" {
+			if len(violations) != 0 {
+				t.Errorf("%s %s: unexpected violations %v", tc.namespace, tc.image, violations)
+			}
+			continue
+		}
+		if len(violations) != 1 || violations[0].Mode != tc.mode ||
+			!strings.Contains(violations[0].Err.Detail, tc.detail) || !strings.Contains(violations[0].Err.Detail, `container "app"`) {
+			t.Errorf("%s %s: expected a %s violation about %q, got %v", tc.namespace, tc.image, tc.mode, tc.detail, violations)
+		}
+	}
+}
+
+func TestPodSpecImages(t *testing.T) {
+	spec := &corev1.PodSpec{
+		InitContainers: []corev1.Container{{Name: "init", Image: "busybox:1.36"}},
+		Containers:     []corev1.Container{{Name: "app", Image: "nginx:1.19"}, {Name: "sidecar", Image: "socp.io/zk/sidecar:0407"}},
+	}
+	images := podSpecImages(spec, field.NewPath("spec", "template", "spec"))
+	want := []string{
+		"spec.template.spec.initContainers[0].image",
+		"spec.template.spec.containers[0].image",
+		"spec.template.spec.containers[1].image",
+	}
+	if len(images) != len(want) {
+		t.Fatalf("unexpected images %v", images)
+	}
+	for i, image := range images {
+		if image.path.String() != want[i] {
+			t.Errorf("expected %s, got %s", want[i], image.path)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ingressIndexName indexes Applications by the host and path of their
+// ingress.
+const ingressIndexName = "ingress"
+
+// ingressIndex finds the Applications, in any namespace, that already own an
+// ingress host and path. It is backed by an informer cache of Applications.
+type ingressIndex struct {
+	indexer cache.Indexer
+	synced  cache.InformerSynced
+}
+
+// newIngressIndex adds the ingress index to informer, which must not have
+// been started yet.
+func newIngressIndex(informer cache.SharedIndexInformer) (*ingressIndex, error) {
+	if err := informer.AddIndexers(cache.Indexers{ingressIndexName: indexIngress}); err != nil {
+		return nil, err
+	}
+	return &ingressIndex{
+		indexer: informer.GetIndexer(),
+		synced:  informer.HasSynced,
+	}, nil
+}
+
+func indexIngress(obj interface{}) ([]string, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, nil
+	}
+	host, _, _ := unstructured.NestedString(u.Object, "spec", "optTraits", "ingress", "host")
+	if host == "" {
+		return nil, nil
+	}
+	path, _, _ := unstructured.NestedString(u.Object, "spec", "optTraits", "ingress", "path")
+	return []string{ingressKey(host, path)}, nil
+}
+
+// ingressKey identifies an ingress route. Hosts are case insensitive.
+func ingressKey(host, path string) string {
+	return strings.ToLower(host) + path
+}
+
+// Check rejects app if another Application already owns its ingress host and
+// path. Sharing is allowed when both Applications carry the shared ingress
+// annotation.
+func (ii *ingressIndex) Check(app *Application) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if ii == nil {
+		return allErrs
+	}
+	ingress := app.Spec.OptTraits.Ingress
+	if ingress.Host == "" {
+		return allErrs
+	}
+	if !ii.synced() {
+		glog.Warningf("Application cache is not synced yet, skipping ingress check for %s/%s", app.Namespace, app.Name)
+		return allErrs
+	}
+	objs, err := ii.indexer.ByIndex(ingressIndexName, ingressKey(ingress.Host, ingress.Path))
+	if err != nil {
+		return append(allErrs, field.InternalError(nil, err))
+	}
+
+	shared := sharesIngress(app.Annotations)
+	var owners []string
+	for _, obj := range objs {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok || (u.GetNamespace() == app.Namespace && u.GetName() == app.Name) {
+			continue
+		}
+		if shared && sharesIngress(u.GetAnnotations()) {
+			continue
+		}
+		owners = append(owners, u.GetNamespace()+"/"+u.GetName())
+	}
+	if len(owners) != 0 {
+		sort.Strings(owners)
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "optTraits", "ingress", "host"),
+			fmt.Sprintf("host %s with path %q is already used by Application %s; set the annotation %s: \"true\" on both Applications to share it",
+				ingress.Host, ingress.Path, strings.Join(owners, ", "), admissionWebhookAnnotationSharedIngressKey)))
+	}
+	return allErrs
+}
+
+func sharesIngress(annotations map[string]string) bool {
+	switch strings.ToLower(annotations[admissionWebhookAnnotationSharedIngressKey]) {
+	case "y", "yes", "true", "on":
+		return true
+	}
+	return false
+}
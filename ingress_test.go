@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+var applicationGVR = schema.GroupVersionResource{Group: "qikqiak.com", Version: "v1", Resource: "applications"}
+
+func applicationObject(namespace, name, host, path string, annotations map[string]string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "qikqiak.com/v1",
+		"kind":       "Application",
+		"spec": map[string]interface{}{
+			"optTraits": map[string]interface{}{
+				"ingress": map[string]interface{}{"host": host, "path": path},
+			},
+		},
+	}}
+	u.SetNamespace(namespace)
+	u.SetName(name)
+	u.SetAnnotations(annotations)
+	return u
+}
+
+func newFakeIngressIndex(t *testing.T, objects ...runtime.Object) *ingressIndex {
+	t.Helper()
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{applicationGVR: "ApplicationList"}, objects...)
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, 0)
+	ii, err := newIngressIndex(factory.ForResource(applicationGVR).Informer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	factory.Start(stop)
+	factory.WaitForCacheSync(stop)
+	return ii
+}
+
+func TestIngressIndexCheck(t *testing.T) {
+	shared := map[string]string{admissionWebhookAnnotationSharedIngressKey: "true"}
+	ii := newFakeIngressIndex(t,
+		applicationObject("team-a", "shop", "shop.example.com", "/", nil),
+		applicationObject("team-a", "api", "api.example.com", "/", shared),
+	)
+
+	app := validApplication()
+	app.Namespace, app.Name = "team-b", "shop"
+	for _, tc := range []struct {
+		host, path  string
+		annotations map[string]string
+		conflict    string
+	}{
+		{"demo.example.com", "/", nil, ""},
+		{"shop.example.com", "/", nil, "team-a/shop"},
+		{"Shop.Example.com", "/", nil, "team-a/shop"},
+		{"shop.example.com", "/", shared, "team-a/shop"},
+		{"shop.example.com", "/v2", nil, ""},
+		{"api.example.com", "/", nil, "team-a/api"},
+		{"api.example.com", "/", shared, ""},
+	} {
+		app.Spec.OptTraits.Ingress.Host, app.Spec.OptTraits.Ingress.Path = tc.host, tc.path
+		app.Annotations = tc.annotations
+		errs := ii.Check(app)
+		if tc.conflict == "" {
+			if len(errs) != 0 {
+				t.Errorf("%s%s: unexpected errors %v", tc.host, tc.path, errs)
+			}
+			continue
+		}
+		if len(errs) != 1 || errs[0].Field != "spec.optTraits.ingress.host" || !strings.Contains(errs[0].Detail, tc.conflict) {
+			t.Errorf("%s%s: expected a conflict with %s, got %v", tc.host, tc.path, tc.conflict, errs)
+		}
+	}
+
+	// an Application does not conflict with itself on update
+	app.Namespace, app.Name = "team-a", "shop"
+	app.Spec.OptTraits.Ingress.Host, app.Spec.OptTraits.Ingress.Path = "shop.example.com", "/"
+	app.Annotations = nil
+	if errs := ii.Check(app); len(errs) != 0 {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
@@ -11,6 +11,12 @@ import (
 	"syscall"
 
 	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 func main() {
@@ -21,25 +27,94 @@ func main() {
 	flag.StringVar(&parameters.certFile, "tlsCertFile", "/etc/webhook/certs/cert.pem", "File containing the x509 Certificate for HTTPS.")
 	flag.StringVar(&parameters.keyFile, "tlsKeyFile", "/etc/webhook/certs/key.pem", "File containing the x509 private key to --tlsCertFile.")
 	flag.StringVar(&parameters.sidecarCfgFile, "sidecarCfgFile", "/etc/webhook/config/sidecarconfig.yaml", "File containing the mutation configuration.")
+	flag.StringVar(&parameters.policyFile, "policyFile", "", "File containing the validation policy, the built-in policy is used if empty.")
+	flag.BoolVar(&parameters.quotaCheck, "quotaCheck", false, "Reject Applications that exceed the ResourceQuota headroom of their namespace. Needs in-cluster API access.")
+	flag.BoolVar(&parameters.ingressCheck, "ingressCheck", false, "Reject Applications whose ingress host and path is used by another Application. Needs in-cluster API access.")
+	flag.StringVar(&parameters.appResource, "applicationResource", "applications.v1.qikqiak.com", "Resource of Applications, as resource.version.group.")
 	flag.Parse()
-	sidecarConfig, err := loadConfig(parameters.sidecarCfgFile)
-	pair, err := tls.LoadX509KeyPair(parameters.certFile, parameters.keyFile)
+	certs, err := newCertWatcher(parameters.certFile, parameters.keyFile)
 	if err != nil {
-		glog.Errorf("Failed to load key pair: %v", err)
+		glog.Fatalf("Failed to load key pair: %v", err)
 	}
 
 	whsvr := &WebhookServer{
-		sidecarConfig: sidecarConfig,
+		sidecarCfgFile: parameters.sidecarCfgFile,
+		policyFile:     parameters.policyFile,
 		server: &http.Server{
 			Addr:      fmt.Sprintf(":%v", parameters.port),
-			TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}},
+			TLSConfig: &tls.Config{GetCertificate: certs.GetCertificate},
 		},
 	}
+	if err := whsvr.reloadSidecarConfig(); err != nil {
+		glog.Fatalf("Failed to load sidecar configuration: %v", err)
+	}
+	if err := whsvr.reloadPolicy(); err != nil {
+		glog.Fatalf("Failed to load policy: %v", err)
+	}
+
+	var config *rest.Config
+	if parameters.quotaCheck || parameters.ingressCheck {
+		if config, err = rest.InClusterConfig(); err != nil {
+			glog.Fatalf("Failed to get in-cluster config: %v", err)
+		}
+	}
+	var factory informers.SharedInformerFactory
+	if parameters.quotaCheck {
+		client, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			glog.Fatalf("Failed to create Kubernetes client: %v", err)
+		}
+		factory = newInformerFactory(client)
+		whsvr.quota = newQuotaChecker(factory)
+	}
+	var dynamicFactory dynamicinformer.DynamicSharedInformerFactory
+	if parameters.ingressCheck {
+		gvr, _ := schema.ParseResourceArg(parameters.appResource)
+		if gvr == nil {
+			glog.Fatalf("Invalid Application resource %q, expected resource.version.group", parameters.appResource)
+		}
+		client, err := dynamic.NewForConfig(config)
+		if err != nil {
+			glog.Fatalf("Failed to create dynamic Kubernetes client: %v", err)
+		}
+		dynamicFactory = dynamicinformer.NewDynamicSharedInformerFactory(client, 0)
+		if whsvr.ingress, err = newIngressIndex(dynamicFactory.ForResource(*gvr).Informer()); err != nil {
+			glog.Fatalf("Failed to index Applications: %v", err)
+		}
+	}
+
+	stopCh := make(chan struct{})
+	if factory != nil {
+		factory.Start(stopCh)
+		for informer, synced := range factory.WaitForCacheSync(stopCh) {
+			if !synced {
+				glog.Fatalf("Failed to sync informer cache for %v", informer)
+			}
+		}
+	}
+	if dynamicFactory != nil {
+		dynamicFactory.Start(stopCh)
+		for gvr, synced := range dynamicFactory.WaitForCacheSync(stopCh) {
+			if !synced {
+				glog.Fatalf("Failed to sync informer cache for %v", gvr)
+			}
+		}
+	}
+	if err := certs.Watch(stopCh); err != nil {
+		glog.Fatalf("Failed to watch key pair: %v", err)
+	}
+	if err := whsvr.watchSidecarConfig(stopCh); err != nil {
+		glog.Fatalf("Failed to watch sidecar configuration: %v", err)
+	}
+	if err := whsvr.watchPolicy(stopCh); err != nil {
+		glog.Fatalf("Failed to watch policy: %v", err)
+	}
 
 	// define http server and server handler
 	mux := http.NewServeMux()
 	mux.HandleFunc("/mutate", whsvr.serve)
 	mux.HandleFunc("/validate", whsvr.serve)
+	mux.HandleFunc("/config/sha256", whsvr.serveConfigSum)
 	whsvr.server.Handler = mux
 
 	// start webhook server in new routine
@@ -57,5 +132,6 @@ func main() {
 	<-signalChan
 
 	glog.Infof("Got OS shutdown signal, shutting down webhook server gracefully...")
+	close(stopCh)
 	whsvr.server.Shutdown(context.Background())
 }
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// downwardAPIFields are the pod fields an env var can reference with
+// fromParam instead of a declared parameter.
+var downwardAPIFields = []string{"spec.nodeName", "metadata.name", "metadata.namespace", "status.podIP"}
+
+// parameterTypes are the supported Parameter.Type values. int, float, bool
+// and json are accepted for Applications written against the older types.
+var parameterTypes = []string{"string", "number", "boolean", "int", "float", "bool", "json"}
+
+// applicationParameters returns the parameter values supplied in the
+// parameters annotation of app, a JSON object of strings keyed by parameter
+// name.
+func applicationParameters(app *Application) (map[string]string, error) {
+	values := map[string]string{}
+	raw, ok := app.Annotations[admissionWebhookAnnotationParametersKey]
+	if !ok {
+		return values, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &values); err != nil {
+		return nil, fmt.Errorf("must be a JSON object of strings: %v", err)
+	}
+	return values, nil
+}
+
+// checkParameterValue returns why value is not of type typ, or nil.
+func checkParameterValue(typ, value string) error {
+	switch typ {
+	case "string":
+		return nil
+	case "number", "float":
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+	case "int":
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+	case "boolean", "bool":
+		if value != "true" && value != "false" {
+			return fmt.Errorf("%q is not a boolean, use true or false", value)
+		}
+	case "json":
+		if !json.Valid([]byte(value)) {
+			return fmt.Errorf("%q is not valid JSON", value)
+		}
+	}
+	return nil
+}
+
+// resolveParameters returns the value of every parameter of com that has
+// one, either supplied or its default.
+func resolveParameters(com *Component, supplied map[string]string) map[string]string {
+	resolved := map[string]string{}
+	for _, param := range com.Parameters {
+		if value, ok := supplied[param.Name]; ok {
+			resolved[param.Name] = value
+		} else if param.Default != "" {
+			resolved[param.Name] = param.Default
+		}
+	}
+	return resolved
+}
+
+// validateApplicationParameters checks the parameters of every component of
+// app, the values supplied for them and the fromParam references to them.
+func validateApplicationParameters(app *Application) field.ErrorList {
+	allErrs := field.ErrorList{}
+	annotationPath := field.NewPath("metadata", "annotations").Key(admissionWebhookAnnotationParametersKey)
+	supplied, err := applicationParameters(app)
+	if err != nil {
+		return append(allErrs, field.Invalid(annotationPath, app.Annotations[admissionWebhookAnnotationParametersKey], err.Error()))
+	}
+
+	declared := map[string]bool{}
+	componentsPath := field.NewPath("spec", "components")
+	for i, com := range app.Spec.Components {
+		comPath := componentsPath.Index(i)
+		allErrs = append(allErrs, validateParameters(com.Parameters, supplied, comPath.Child("parameters"))...)
+		params := map[string]bool{}
+		for _, param := range com.Parameters {
+			params[param.Name] = true
+			declared[param.Name] = true
+		}
+		allErrs = append(allErrs, validateParameterReferences(&com, params, comPath)...)
+	}
+
+	names := make([]string, 0, len(supplied))
+	for name := range supplied {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !declared[name] {
+			allErrs = append(allErrs, field.Invalid(annotationPath, name, "no component declares this parameter"))
+		}
+	}
+	return allErrs
+}
+
+func validateParameters(params []Parameter, supplied map[string]string, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	names := map[string]bool{}
+	for i, param := range params {
+		paramPath := fldPath.Index(i)
+		if param.Name == "" {
+			allErrs = append(allErrs, field.Required(paramPath.Child("name"), ""))
+		} else if names[param.Name] {
+			allErrs = append(allErrs, field.Duplicate(paramPath.Child("name"), param.Name))
+		}
+		names[param.Name] = true
+
+		supported := false
+		for _, typ := range parameterTypes {
+			if param.Type == typ {
+				supported = true
+			}
+		}
+		if !supported {
+			allErrs = append(allErrs, field.NotSupported(paramPath.Child("type"), param.Type, parameterTypes))
+			continue
+		}
+		if param.Default != "" {
+			if err := checkParameterValue(param.Type, param.Default); err != nil {
+				allErrs = append(allErrs, field.Invalid(paramPath.Child("default"), param.Default, err.Error()))
+			}
+		}
+		value, ok := supplied[param.Name]
+		switch {
+		case ok:
+			if err := checkParameterValue(param.Type, value); err != nil {
+				allErrs = append(allErrs, field.Invalid(field.NewPath("metadata", "annotations").Key(admissionWebhookAnnotationParametersKey), value,
+					fmt.Sprintf("parameter %s: %v", param.Name, err)))
+			}
+		case param.Required && param.Default == "":
+			allErrs = append(allErrs, field.Required(paramPath.Child("default"),
+				fmt.Sprintf("parameter %s is required, set a default or supply it in the annotation %s", param.Name, admissionWebhookAnnotationParametersKey)))
+		}
+	}
+	return allErrs
+}
+
+// validateParameterReferences checks that every fromParam of com names one of
+// params. Env vars may also reference a downward API field.
+func validateParameterReferences(com *Component, params map[string]bool, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	for i, con := range com.Containers {
+		conPath := fldPath.Child("containers").Index(i)
+		for j, env := range con.Env {
+			if env.FromParam == "" || params[env.FromParam] || isDownwardAPIField(env.FromParam) {
+				continue
+			}
+			allErrs = append(allErrs, field.Invalid(conPath.Child("env").Index(j).Child("fromParam"), env.FromParam,
+				fmt.Sprintf("must be a parameter of the component or one of %q", downwardAPIFields)))
+		}
+		for j, config := range con.Config {
+			if config.FromParam != "" && !params[config.FromParam] {
+				allErrs = append(allErrs, field.Invalid(conPath.Child("config").Index(j).Child("fromParam"), config.FromParam, "must be a parameter of the component"))
+			}
+		}
+	}
+	for i, setting := range com.WorkloadSettings {
+		if setting.FromParam != "" && !params[setting.FromParam] {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("workloadSetings").Index(i).Child("fromParam"), setting.FromParam, "must be a parameter of the component"))
+		}
+	}
+	return allErrs
+}
+
+// findParameter returns the parameter of params called name, or nil.
+func findParameter(params []Parameter, name string) *Parameter {
+	for i := range params {
+		if params[i].Name == name {
+			return &params[i]
+		}
+	}
+	return nil
+}
+
+// isSubstituted reports whether value is the resolved value of the parameter
+// name, as set by createApplicationPatch next to fromParam.
+func isSubstituted(params map[string]string, name, value string) bool {
+	resolved, ok := params[name]
+	return ok && resolved == value
+}
+
+func isDownwardAPIField(name string) bool {
+	for _, f := range downwardAPIFields {
+		if name == f {
+			return true
+		}
+	}
+	return false
+}
+
+// createApplicationPatch sets the value of everything that references a
+// parameter with fromParam to the resolved value of the parameter. fromParam
+// is kept so that the reference survives later updates. References to
+// downward API fields and to parameters without a value are left for the
+// controller.
+func createApplicationPatch(app *Application) ([]byte, error) {
+	supplied, err := applicationParameters(app)
+	if err != nil {
+		return nil, fmt.Errorf("annotation %s %v", admissionWebhookAnnotationParametersKey, err)
+	}
+	var patch []patchOperation
+	substitute := func(basePath string, resolved map[string]string, name string) {
+		value, ok := resolved[name]
+		if !ok {
+			return
+		}
+		patch = append(patch, patchOperation{Op: "add", Path: basePath + "/value", Value: value})
+	}
+	for i, com := range app.Spec.Components {
+		resolved := resolveParameters(&com, supplied)
+		comPath := fmt.Sprintf("/spec/components/%d", i)
+		for j, con := range com.Containers {
+			conPath := fmt.Sprintf("%s/containers/%d", comPath, j)
+			for k, env := range con.Env {
+				if env.FromParam != "" {
+					substitute(fmt.Sprintf("%s/env/%d", conPath, k), resolved, env.FromParam)
+				}
+			}
+			for k, config := range con.Config {
+				if config.FromParam != "" {
+					substitute(fmt.Sprintf("%s/config/%d", conPath, k), resolved, config.FromParam)
+				}
+			}
+		}
+		for j, setting := range com.WorkloadSettings {
+			if setting.FromParam != "" {
+				substitute(fmt.Sprintf("%s/workloadSetings/%d", comPath, j), resolved, setting.FromParam)
+			}
+		}
+	}
+	if len(patch) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(patch)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func parameterizedApplication() *Application {
+	app := validApplication()
+	com := &app.Spec.Components[0]
+	com.Parameters = []Parameter{
+		{Name: "logLevel", Type: "string", Default: "info"},
+		{Name: "workers", Type: "number", Required: true},
+		{Name: "debug", Type: "boolean"},
+	}
+	com.Containers[0].Env = []CEnvVar{
+		{Name: "LOG_LEVEL", FromParam: "logLevel"},
+		{Name: "WORKERS", FromParam: "workers"},
+		{Name: "DEBUG", FromParam: "debug"},
+		{Name: "NODE", FromParam: "spec.nodeName"},
+	}
+	com.Containers[0].Config = []ConfigFile{{Path: "/etc/nginx", FileName: "workers.conf", FromParam: "workers"}}
+	app.Annotations = map[string]string{admissionWebhookAnnotationParametersKey: `{"workers":"4"}`}
+	return app
+}
+
+func TestValidateApplicationParameters(t *testing.T) {
+	if errs := validateApplicationParameters(parameterizedApplication()); len(errs) != 0 {
+		t.Fatalf("expected valid parameters, got %v", errs)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(app *Application)
+		field  string
+	}{
+		{"required not supplied", func(app *Application) { delete(app.Annotations, admissionWebhookAnnotationParametersKey) }, "spec.components[0].parameters[1].default"},
+		{"supplied value of wrong type", func(app *Application) {
+			app.Annotations[admissionWebhookAnnotationParametersKey] = `{"workers":"four"}`
+		}, "metadata.annotations[admission-webhook-example.qikqiak.com/parameters]"},
+		{"undeclared supplied value", func(app *Application) {
+			app.Annotations[admissionWebhookAnnotationParametersKey] = `{"workers":"4","color":"red"}`
+		}, "metadata.annotations[admission-webhook-example.qikqiak.com/parameters]"},
+		{"malformed annotation", func(app *Application) {
+			app.Annotations[admissionWebhookAnnotationParametersKey] = `workers=4`
+		}, "metadata.annotations[admission-webhook-example.qikqiak.com/parameters]"},
+		{"default of wrong type", func(app *Application) {
+			app.Spec.Components[0].Parameters[2].Default = "yes"
+		}, "spec.components[0].parameters[2].default"},
+		{"unsupported type", func(app *Application) {
+			app.Spec.Components[0].Parameters[0].Type = "list"
+		}, "spec.components[0].parameters[0].type"},
+		{"duplicate name", func(app *Application) {
+			app.Spec.Components[0].Parameters = append(app.Spec.Components[0].Parameters, Parameter{Name: "debug", Type: "boolean"})
+		}, "spec.components[0].parameters[3].name"},
+		{"undeclared env reference", func(app *Application) {
+			app.Spec.Components[0].Containers[0].Env[0].FromParam = "spec.hostname"
+		}, "spec.components[0].containers[0].env[0].fromParam"},
+		{"downward API field in config", func(app *Application) {
+			app.Spec.Components[0].Containers[0].Config[0].FromParam = "metadata.name"
+		}, "spec.components[0].containers[0].config[0].fromParam"},
+		{"undeclared workload setting reference", func(app *Application) {
+			app.Spec.Components[0].WorkloadSettings = []WorkloadSetting{{Name: "restartPolicy", FromParam: "restart"}}
+		}, "spec.components[0].workloadSetings[0].fromParam"},
+	}
+	for _, test := range tests {
+		app := parameterizedApplication()
+		test.modify(app)
+		errs := validateApplicationParameters(app)
+		if len(errs) != 1 || errs[0].Field != test.field {
+			t.Errorf("%s: expected an error for %s, got %v", test.name, test.field, errs)
+		}
+	}
+}
+
+func TestValidationChecksResolvedParameters(t *testing.T) {
+	if errs := parameterizedApplication().Validation(); len(errs) != 0 {
+		t.Fatalf("expected valid application, got %v", errs)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(app *Application)
+		field  string
+	}{
+		{"restart policy from a default", func(app *Application) {
+			app.Spec.Components[0].Parameters = append(app.Spec.Components[0].Parameters, Parameter{Name: "restart", Type: "string", Default: "Never"})
+			app.Spec.Components[0].WorkloadSettings = []WorkloadSetting{{Name: "restartPolicy", FromParam: "restart"}}
+		}, "spec.components[0].workloadSetings[0].fromParam"},
+		{"restart policy from a supplied value", func(app *Application) {
+			app.Spec.Components[0].Parameters = append(app.Spec.Components[0].Parameters, Parameter{Name: "restart", Type: "string", Default: "Always"})
+			app.Spec.Components[0].WorkloadSettings = []WorkloadSetting{{Name: "restartPolicy", FromParam: "restart"}}
+			app.Annotations[admissionWebhookAnnotationParametersKey] = `{"workers":"4","restart":"OnFailure"}`
+		}, "spec.components[0].workloadSetings[0].fromParam"},
+		{"restart policy from a parameter without value", func(app *Application) {
+			app.Spec.Components[0].Parameters = append(app.Spec.Components[0].Parameters, Parameter{Name: "restart", Type: "string"})
+			app.Spec.Components[0].WorkloadSettings = []WorkloadSetting{{Name: "restartPolicy", FromParam: "restart"}}
+		}, "spec.components[0].workloadSetings[0].fromParam"},
+		{"value other than the parameter", func(app *Application) {
+			app.Spec.Components[0].Containers[0].Env[1].Value = "8"
+		}, "spec.components[0].containers[0].env[1].fromParam"},
+	}
+	for _, test := range tests {
+		app := parameterizedApplication()
+		test.modify(app)
+		errs := app.Validation()
+		if len(errs) != 1 || errs[0].Field != test.field {
+			t.Errorf("%s: expected an error for %s, got %v", test.name, test.field, errs)
+		}
+	}
+
+	// the values substituted on mutation are kept next to fromParam
+	app := parameterizedApplication()
+	app.Spec.Components[0].Parameters = append(app.Spec.Components[0].Parameters, Parameter{Name: "restart", Type: "string", Default: "Always"})
+	app.Spec.Components[0].WorkloadSettings = []WorkloadSetting{{Name: "restartPolicy", FromParam: "restart", Value: "Always"}}
+	app.Spec.Components[0].Containers[0].Env[1].Value = "4"
+	app.Spec.Components[0].Containers[0].Config[0].Value = "4"
+	if errs := app.Validation(); len(errs) != 0 {
+		t.Errorf("expected substituted values to be valid, got %v", errs)
+	}
+}
+
+func TestValidateParameterTypes(t *testing.T) {
+	tests := []struct {
+		typ            string
+		valid, invalid string
+	}{
+		{"string", "anything", ""},
+		{"number", "1.5", "one"},
+		{"boolean", "true", "yes"},
+		{"int", "42", "1.5"},
+		{"float", "-0.5", "half"},
+		{"bool", "false", "0"},
+		{"json", `{"a":[1]}`, `{"a":`},
+	}
+	if len(tests) != len(parameterTypes) {
+		t.Fatalf("expected a test for each of %q", parameterTypes)
+	}
+	for _, test := range tests {
+		params := []Parameter{{Name: "p", Type: test.typ, Default: test.valid}}
+		if errs := validateParameters(params, nil, field.NewPath("parameters")); len(errs) != 0 {
+			t.Errorf("%s: expected %q to be valid, got %v", test.typ, test.valid, errs)
+		}
+		if test.invalid == "" {
+			continue
+		}
+		params[0].Default = test.invalid
+		if errs := validateParameters(params, nil, field.NewPath("parameters")); len(errs) != 1 || errs[0].Field != "parameters[0].default" {
+			t.Errorf("%s: expected %q to be rejected, got %v", test.typ, test.invalid, errs)
+		}
+	}
+
+	errs := validateParameters([]Parameter{{Name: "p", Type: "list"}}, nil, field.NewPath("parameters"))
+	if len(errs) != 1 || errs[0].Type != field.ErrorTypeNotSupported || !strings.Contains(errs[0].Detail, `"json"`) {
+		t.Errorf("expected every accepted type to be listed, got %v", errs)
+	}
+}
+
+func TestMutateApplicationSubstitutesParameters(t *testing.T) {
+	app := parameterizedApplication()
+	app.Annotations[admissionWebhookAnnotationParametersKey] = `{"workers":"4","logLevel":""}`
+	raw, err := json.Marshal(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &admissionv1.AdmissionRequest{
+		Kind:      metav1.GroupVersionKind{Group: "qikqiak.com", Version: "v1", Kind: "Application"},
+		Namespace: "default",
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+	patch := mutatePatch(t, &WebhookServer{}, req)
+
+	// the empty logLevel is supplied and overrides the default, debug has no
+	// value and spec.nodeName is resolved by the controller
+	want := []patchOperation{
+		{Op: "add", Path: "/spec/components/0/containers/0/env/0/value", Value: ""},
+		{Op: "add", Path: "/spec/components/0/containers/0/env/1/value", Value: "4"},
+		{Op: "add", Path: "/spec/components/0/containers/0/config/0/value", Value: "4"},
+	}
+	if len(patch) != len(want) {
+		t.Fatalf("got %v, want %v", patch, want)
+	}
+	for i := range want {
+		if patch[i] != want[i] {
+			t.Errorf("patch %d: got %v, want %v", i, patch[i], want[i])
+		}
+	}
+}
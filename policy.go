@@ -0,0 +1,629 @@
+package main
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	"github.com/google/cel-go/cel"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// defaultPolicy is used when no policy file is configured.
+//
+//go:embed default-policy.yaml
+var defaultPolicy []byte
+
+// PolicyMode decides what happens to an object that violates a rule.
+type PolicyMode string
+
+const (
+	// PolicyModeEnforce rejects the object
+	PolicyModeEnforce PolicyMode = "enforce"
+	// PolicyModeWarn admits the object and returns the violation as an
+	// admission warning
+	PolicyModeWarn PolicyMode = "warn"
+	// PolicyModeAudit admits the object and only records the violation in the
+	// decision log
+	PolicyModeAudit PolicyMode = "audit"
+)
+
+// Policy is a set of declarative rules checked against admitted objects.
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+	// NamespaceModes overrides the mode of every rule for objects in the given
+	// namespaces
+	NamespaceModes map[string]PolicyMode `json:"namespaceModes,omitempty"`
+	// Images restricts the container images of Applications and Pods
+	Images *ImagePolicy `json:"images,omitempty"`
+	// Resources bounds the CPU and memory of Applications
+	Resources *ResourcePolicy `json:"resources,omitempty"`
+	// RouteTimeout is the timeout of the HTTP routes generated for
+	// Applications, which their retries must fit in
+	RouteTimeout string `json:"routeTimeout,omitempty"`
+	// CELCostLimit bounds the total cost of the CEL expressions evaluated for
+	// one admission request. It is split evenly among the CEL rules of the
+	// kind with the most of them
+	CELCostLimit uint64 `json:"celCostLimit,omitempty"`
+
+	// sha256 is the checksum of the file the policy was loaded from
+	sha256       string
+	routeTimeout time.Duration
+}
+
+// PolicyRule checks the values found at Path in objects of the given kinds.
+// Every check that is set must pass. A rule may instead hold a CEL Expression
+// over the admitted object, which must evaluate to true.
+type PolicyRule struct {
+	Name string `json:"name"`
+	// Kinds the rule applies to, Application if empty
+	Kinds []string `json:"kinds,omitempty"`
+	// Expression is a CEL expression such as
+	// object.spec.components.all(c, c.componentTraits.replicas <= 10)
+	Expression string `json:"expression,omitempty"`
+	// Path is a JSON path such as spec.components[*].containers[*].image. [*]
+	// matches every element of a list, [n] a single one and ['key'] a map key
+	// that contains dots.
+	Path     string   `json:"path"`
+	Required bool     `json:"required,omitempty"`
+	Regex    string   `json:"regex,omitempty"`
+	Enum     []string `json:"enum,omitempty"`
+	Minimum  *float64 `json:"minimum,omitempty"`
+	Maximum  *float64 `json:"maximum,omitempty"`
+	// When restricts the rule to the objects matching the condition
+	When *PolicyCondition `json:"when,omitempty"`
+	// Message replaces the generic description of a violation
+	Message string `json:"message,omitempty"`
+	// Mode of the rule, enforce if empty
+	Mode PolicyMode `json:"mode,omitempty"`
+	// NamespaceModes overrides Mode, and the namespace modes of the policy,
+	// for objects in the given namespaces
+	NamespaceModes map[string]PolicyMode `json:"namespaceModes,omitempty"`
+
+	path    []pathSegment
+	regex   *regexp.Regexp
+	program cel.Program
+}
+
+// PolicyCondition selects the objects a rule applies to. Each [*] in Path
+// refers to the same element as the corresponding [*] in the path of the
+// rule, e.g. spec.components[*].workloadType selects the component whose field
+// is being checked.
+type PolicyCondition struct {
+	Path string `json:"path"`
+	// Present set to false requires Path not to exist. Otherwise the condition
+	// holds if Path has a value that satisfies In and NotIn.
+	Present *bool    `json:"present,omitempty"`
+	In      []string `json:"in,omitempty"`
+	NotIn   []string `json:"notIn,omitempty"`
+
+	path []pathSegment
+}
+
+// PolicyViolation is a failed check of a rule together with the mode the rule
+// runs in for the namespace of the object.
+type PolicyViolation struct {
+	Rule string
+	Mode PolicyMode
+	Err  *field.Error
+}
+
+type pathSegment struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// pathMatch is a value found by resolving a path. bindings holds the list
+// index or map key chosen for every wildcard on the way.
+type pathMatch struct {
+	path     *field.Path
+	value    interface{}
+	found    bool
+	bindings []interface{}
+}
+
+func loadPolicy(policyFile string) (*Policy, error) {
+	data := defaultPolicy
+	if policyFile != "" {
+		var err error
+		if data, err = ioutil.ReadFile(policyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	var policy Policy
+	if err := yaml.Unmarshal(data, &policy); err != nil {
+		return nil, err
+	}
+	if err := policy.compile(); err != nil {
+		return nil, err
+	}
+	policy.sha256 = fmt.Sprintf("%x", sha256.Sum256(data))
+	glog.Infof("New policy: %d rules, sha256sum %s", len(policy.Rules), policy.sha256)
+	return &policy, nil
+}
+
+// compile parses the paths, regular expressions and CEL expressions of every
+// rule.
+func (p *Policy) compile() error {
+	if p.CELCostLimit == 0 {
+		p.CELCostLimit = defaultCELCostLimit
+	}
+	env, err := newCELEnv()
+	if err != nil {
+		return err
+	}
+	if err := validateNamespaceModes(p.NamespaceModes); err != nil {
+		return err
+	}
+	if p.Images != nil {
+		if err := p.Images.validate(); err != nil {
+			return fmt.Errorf("images: %v", err)
+		}
+	}
+	if p.Resources != nil {
+		if err := p.Resources.validate(); err != nil {
+			return fmt.Errorf("resources: %v", err)
+		}
+	}
+	if p.RouteTimeout != "" {
+		if p.routeTimeout, err = parseDuration(p.RouteTimeout); err != nil {
+			return fmt.Errorf("routeTimeout: %v", err)
+		}
+	}
+
+	// every CEL rule gets an even share of the limit, so the rules evaluated
+	// for one kind never exceed it together
+	celRules := map[string]uint64{}
+	var maxCELRules uint64
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Expression == "" {
+			continue
+		}
+		kinds := rule.Kinds
+		if len(kinds) == 0 {
+			kinds = []string{"Application"}
+		}
+		for _, kind := range kinds {
+			if celRules[kind]++; celRules[kind] > maxCELRules {
+				maxCELRules = celRules[kind]
+			}
+		}
+	}
+	var celRuleLimit uint64
+	if maxCELRules != 0 {
+		if celRuleLimit = p.CELCostLimit / maxCELRules; celRuleLimit == 0 {
+			return fmt.Errorf("celCostLimit %d is too small for %d CEL rules", p.CELCostLimit, maxCELRules)
+		}
+	}
+
+	names := map[string]bool{}
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Name == "" {
+			return fmt.Errorf("rule %d: name is required", i)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("rule %q: duplicate name", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if err := validateMode(rule.Mode); err != nil {
+			return fmt.Errorf("rule %q: %v", rule.Name, err)
+		}
+		if err := validateNamespaceModes(rule.NamespaceModes); err != nil {
+			return fmt.Errorf("rule %q: %v", rule.Name, err)
+		}
+		if rule.Expression != "" {
+			if rule.Path != "" || rule.When != nil {
+				return fmt.Errorf("rule %q: expression cannot be combined with path or when", rule.Name)
+			}
+			if rule.program, err = compileCEL(env, rule.Expression, celRuleLimit); err != nil {
+				return fmt.Errorf("rule %q: %v", rule.Name, err)
+			}
+			continue
+		}
+		if rule.path, err = parsePath(rule.Path); err != nil {
+			return fmt.Errorf("rule %q: %v", rule.Name, err)
+		}
+		if rule.Regex != "" {
+			if rule.regex, err = regexp.Compile(rule.Regex); err != nil {
+				return fmt.Errorf("rule %q: %v", rule.Name, err)
+			}
+		}
+		if !rule.Required && rule.regex == nil && len(rule.Enum) == 0 && rule.Minimum == nil && rule.Maximum == nil {
+			return fmt.Errorf("rule %q: no check configured", rule.Name)
+		}
+		if rule.When != nil {
+			if rule.When.path, err = parsePath(rule.When.Path); err != nil {
+				return fmt.Errorf("rule %q: when: %v", rule.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validateMode(mode PolicyMode) error {
+	switch mode {
+	case "", PolicyModeEnforce, PolicyModeWarn, PolicyModeAudit:
+		return nil
+	}
+	return fmt.Errorf("unsupported mode %q", mode)
+}
+
+func validateNamespaceModes(modes map[string]PolicyMode) error {
+	for namespace, mode := range modes {
+		if err := validateMode(mode); err != nil {
+			return fmt.Errorf("namespace %q: %v", namespace, err)
+		}
+	}
+	return nil
+}
+
+// Evaluate checks raw, the JSON encoding of an object of the given kind in
+// namespace, against every rule that applies to the kind.
+func (p *Policy) Evaluate(kind, namespace string, raw []byte) []PolicyViolation {
+	var violations []PolicyViolation
+	if p == nil {
+		return violations
+	}
+	var obj interface{}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return append(violations, PolicyViolation{Mode: PolicyModeEnforce, Err: field.InternalError(nil, err)})
+	}
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.appliesTo(kind) {
+			continue
+		}
+		var errs field.ErrorList
+		if rule.program != nil {
+			ok, err := evalCEL(rule.program, obj)
+			if err != nil {
+				errs = append(errs, field.Forbidden(nil, fmt.Sprintf("policy rule %q could not be evaluated: %v", rule.Name, err)))
+			} else if !ok {
+				errs = append(errs, field.Forbidden(nil, rule.violation(fmt.Sprintf("must satisfy %s", rule.Expression))))
+			}
+		} else {
+			for _, m := range resolvePath(obj, rule.path) {
+				if rule.When != nil && !rule.When.holds(obj, m.bindings) {
+					continue
+				}
+				if err := rule.check(m); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+		mode := p.mode(rule, namespace)
+		for _, err := range errs {
+			violations = append(violations, PolicyViolation{Rule: rule.Name, Mode: mode, Err: err})
+		}
+	}
+	return violations
+}
+
+// mode returns the mode rule runs in for objects in namespace.
+func (p *Policy) mode(rule *PolicyRule, namespace string) PolicyMode {
+	if mode := rule.NamespaceModes[namespace]; mode != "" {
+		return mode
+	}
+	if mode := p.NamespaceModes[namespace]; mode != "" {
+		return mode
+	}
+	if rule.Mode != "" {
+		return rule.Mode
+	}
+	return PolicyModeEnforce
+}
+
+// sectionMode returns the mode of a section of the policy for namespace: the
+// mode set in the section, the namespace mode of the policy, or enforce.
+func (p *Policy) sectionMode(mode PolicyMode, namespace string) PolicyMode {
+	if mode != "" {
+		return mode
+	}
+	if mode := p.NamespaceModes[namespace]; mode != "" {
+		return mode
+	}
+	return PolicyModeEnforce
+}
+
+// EvaluateRetries checks that all the retries of app fit in the route
+// timeout.
+func (p *Policy) EvaluateRetries(namespace string, app *Application) []PolicyViolation {
+	var violations []PolicyViolation
+	retry := app.Spec.OptTraits.HTTPRetry
+	if p == nil || p.routeTimeout == 0 || retry == nil {
+		return violations
+	}
+	// malformed durations are reported by Validation
+	perTry, err := parseDuration(retry.PerTryTimeout)
+	if err != nil || perTry == 0 {
+		return violations
+	}
+	// compare with the attempts that fit rather than multiplying, which
+	// overflows for large attempts
+	if fit := int64(p.routeTimeout / perTry); int64(retry.Attempts) > fit {
+		err := field.Invalid(field.NewPath("spec", "optTraits", "httpretry", "attempts"), retry.Attempts,
+			fmt.Sprintf("%d attempts of %v take longer than the route timeout of %v, which fits %d", retry.Attempts, perTry, p.routeTimeout, fit))
+		violations = append(violations, PolicyViolation{Rule: "routeTimeout", Mode: p.sectionMode("", namespace), Err: err})
+	}
+	return violations
+}
+
+// splitViolations returns the violations of enforced rules as errors and those
+// of rules in warn mode as admission warnings.
+func splitViolations(violations []PolicyViolation) (field.ErrorList, []string) {
+	var errs field.ErrorList
+	var warnings []string
+	for _, v := range violations {
+		switch v.Mode {
+		case PolicyModeEnforce:
+			errs = append(errs, v.Err)
+		case PolicyModeWarn:
+			warnings = append(warnings, v.Err.Error())
+		}
+	}
+	return errs, warnings
+}
+
+func (r *PolicyRule) appliesTo(kind string) bool {
+	if len(r.Kinds) == 0 {
+		return kind == "Application"
+	}
+	return containsString(r.Kinds, kind)
+}
+
+func (r *PolicyRule) check(m pathMatch) *field.Error {
+	var err *field.Error
+	switch {
+	case !m.found || m.value == "":
+		if !r.Required {
+			return nil
+		}
+		err = field.Required(m.path, "")
+	case len(r.Enum) != 0 && !containsString(r.Enum, policyValueString(m.value)):
+		err = field.NotSupported(m.path, m.value, r.Enum)
+	case r.regex != nil:
+		if s, ok := m.value.(string); !ok || !r.regex.MatchString(s) {
+			err = field.Invalid(m.path, m.value, fmt.Sprintf("must match the regex '%s'", r.regex))
+		}
+	}
+	if err == nil && (r.Minimum != nil || r.Maximum != nil) {
+		n, ok := m.value.(float64)
+		switch {
+		case !ok:
+			err = field.Invalid(m.path, m.value, "must be a number")
+		case r.Minimum != nil && n < *r.Minimum:
+			err = field.Invalid(m.path, m.value, fmt.Sprintf("must be greater than or equal to %v", *r.Minimum))
+		case r.Maximum != nil && n > *r.Maximum:
+			err = field.Invalid(m.path, m.value, fmt.Sprintf("must be less than or equal to %v", *r.Maximum))
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	err.Detail = r.violation(err.Detail)
+	return err
+}
+
+// violation describes a failed check, preferring the message of the rule.
+func (r *PolicyRule) violation(detail string) string {
+	if r.Message != "" {
+		detail = r.Message
+	}
+	return strings.TrimSpace(fmt.Sprintf("%s (policy rule %q)", detail, r.Name))
+}
+
+func (c *PolicyCondition) holds(obj interface{}, bindings []interface{}) bool {
+	var found []pathMatch
+	for _, m := range resolvePath(obj, bindPath(c.path, bindings)) {
+		if m.found {
+			found = append(found, m)
+		}
+	}
+	if c.Present != nil && !*c.Present {
+		return len(found) == 0
+	}
+	for _, m := range found {
+		value := policyValueString(m.value)
+		if len(c.In) != 0 && !containsString(c.In, value) {
+			continue
+		}
+		if len(c.NotIn) != 0 && containsString(c.NotIn, value) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// bindPath replaces the leading wildcards of path with the list indices or map
+// keys a rule path matched.
+func bindPath(path []pathSegment, bindings []interface{}) []pathSegment {
+	bound := make([]pathSegment, len(path))
+	copy(bound, path)
+	for i := range bound {
+		if !bound[i].wildcard || len(bindings) == 0 {
+			continue
+		}
+		switch b := bindings[0].(type) {
+		case int:
+			bound[i] = pathSegment{index: b, isIndex: true}
+		case string:
+			bound[i] = pathSegment{key: b}
+		}
+		bindings = bindings[1:]
+	}
+	return bound
+}
+
+func parsePath(path string) ([]pathSegment, error) {
+	var segments []pathSegment
+	for i := 0; i < len(path); {
+		switch path[i] {
+		case '.':
+			i++
+		case '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("path %q: unterminated [", path)
+			}
+			token := path[i+1 : i+end]
+			i += end + 1
+			switch {
+			case token == "*":
+				segments = append(segments, pathSegment{wildcard: true})
+			case len(token) >= 2 && (token[0] == '\'' || token[0] == '"') && token[len(token)-1] == token[0]:
+				segments = append(segments, pathSegment{key: token[1 : len(token)-1]})
+			default:
+				index, err := strconv.Atoi(token)
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("path %q: invalid index %q", path, token)
+				}
+				segments = append(segments, pathSegment{index: index, isIndex: true})
+			}
+		default:
+			end := strings.IndexAny(path[i:], ".[")
+			if end < 0 {
+				end = len(path) - i
+			}
+			segments = append(segments, pathSegment{key: path[i : i+end]})
+			i += end
+		}
+	}
+	if len(segments) == 0 || segments[0].isIndex || segments[0].wildcard {
+		return nil, fmt.Errorf("path %q must start with a field name", path)
+	}
+	return segments, nil
+}
+
+// resolvePath returns every value path selects in obj. A path that leads to a
+// missing field yields a single match that is not found; a wildcard over a
+// missing or empty list yields nothing.
+func resolvePath(obj interface{}, path []pathSegment) []pathMatch {
+	var matches []pathMatch
+	var walk func(value interface{}, i int, fldPath *field.Path, bindings []interface{})
+	walk = func(value interface{}, i int, fldPath *field.Path, bindings []interface{}) {
+		if i == len(path) {
+			matches = append(matches, pathMatch{path: fldPath, value: value, found: true, bindings: bindings})
+			return
+		}
+		seg := path[i]
+		switch {
+		case seg.wildcard:
+			switch v := value.(type) {
+			case []interface{}:
+				for index, item := range v {
+					walk(item, i+1, fldPath.Index(index), append(bindings[:len(bindings):len(bindings)], index))
+				}
+			case map[string]interface{}:
+				keys := make([]string, 0, len(v))
+				for key := range v {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+				for _, key := range keys {
+					walk(v[key], i+1, fldPath.Key(key), append(bindings[:len(bindings):len(bindings)], key))
+				}
+			}
+		case seg.isIndex:
+			next := fldPath.Index(seg.index)
+			if v, ok := value.([]interface{}); ok && seg.index < len(v) {
+				walk(v[seg.index], i+1, next, bindings)
+				return
+			}
+			matches = append(matches, pathMatch{path: missingPath(next, path[i+1:]), bindings: bindings})
+		default:
+			next := childPath(fldPath, seg.key)
+			if v, ok := value.(map[string]interface{}); ok {
+				if item, ok := v[seg.key]; ok && item != nil {
+					walk(item, i+1, next, bindings)
+					return
+				}
+			}
+			matches = append(matches, pathMatch{path: missingPath(next, path[i+1:]), bindings: bindings})
+		}
+	}
+	walk(obj, 0, nil, nil)
+	return matches
+}
+
+// missingPath extends fldPath with the rest of a path that could not be
+// resolved, up to its first wildcard.
+func missingPath(fldPath *field.Path, rest []pathSegment) *field.Path {
+	for _, seg := range rest {
+		switch {
+		case seg.wildcard:
+			return fldPath
+		case seg.isIndex:
+			fldPath = fldPath.Index(seg.index)
+		default:
+			fldPath = childPath(fldPath, seg.key)
+		}
+	}
+	return fldPath
+}
+
+// childPath renders keys that contain dots or slashes, such as label names, as
+// map keys.
+func childPath(fldPath *field.Path, key string) *field.Path {
+	switch {
+	case fldPath == nil:
+		return field.NewPath(key)
+	case strings.ContainsAny(key, "./"):
+		return fldPath.Key(key)
+	default:
+		return fldPath.Child(key)
+	}
+}
+
+func policyValueString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// reloadPolicy loads policyFile and swaps it in if it is valid and differs
+// from the active one. On error the active policy stays in service.
+func (whsvr *WebhookServer) reloadPolicy() error {
+	policy, err := loadPolicy(whsvr.policyFile)
+	if err != nil {
+		return err
+	}
+	if old := whsvr.policy.Load(); old != nil && old.sha256 == policy.sha256 {
+		return nil
+	}
+	whsvr.policy.Store(policy)
+	glog.Infof("Policy %s is active: sha256sum %s", whsvr.policyFile, policy.sha256)
+	return nil
+}
+
+// watchPolicy reloads the policy whenever policyFile changes.
+func (whsvr *WebhookServer) watchPolicy(stop <-chan struct{}) error {
+	if whsvr.policyFile == "" {
+		return nil
+	}
+	return watchFiles([]string{whsvr.policyFile}, stop, func() {
+		if err := whsvr.reloadPolicy(); err != nil {
+			glog.Errorf("Failed to reload policy, keeping the previous one: %v", err)
+		}
+	})
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func enforced(violations []PolicyViolation) field.ErrorList {
+	errs, _ := splitViolations(violations)
+	return errs
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	policy, err := loadPolicy("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := validApplication()
+	raw, _ := json.Marshal(app)
+	if errs := enforced(policy.Evaluate("Application", "default", raw)); len(errs) != 0 {
+		t.Fatalf("expected valid application, got %v", errs)
+	}
+
+	app.Spec.OptTraits.Ingress.Path = "/api"
+	raw, _ = json.Marshal(app)
+	errs := enforced(policy.Evaluate("Application", "default", raw))
+	if len(errs) != 1 || errs[0].Field != "spec.optTraits.ingress.path" {
+		t.Errorf("unexpected errors %v", errs)
+	}
+
+	app = validApplication()
+	app.Spec.Components[0].WorkloadType = "Bogus"
+	raw, _ = json.Marshal(app)
+	errs = enforced(policy.Evaluate("Application", "default", raw))
+	if len(errs) != 1 || errs[0].Type != field.ErrorTypeNotSupported || errs[0].Field != "spec.components[0].workloadType" {
+		t.Errorf("expected unknown workload type to be rejected, got %v", errs)
+	}
+}
+
+func TestPolicyRules(t *testing.T) {
+	const rules = `
+rules:
+- name: singleton-replicas
+  path: spec.components[*].componentTraits.replicas
+  maximum: 1
+  when:
+    path: spec.components[*].workloadType
+    in: ["SingletonServer"]
+- name: version-format
+  path: spec.components[*].version
+  regex: ^v[0-9]+$
+- name: part-of
+  kinds: ["Deployment"]
+  path: metadata.labels['app.kubernetes.io/part-of']
+  required: true
+`
+	var policy Policy
+	if err := yaml.Unmarshal([]byte(rules), &policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	app := validApplication()
+	app.Spec.Components = append(app.Spec.Components, app.Spec.Components[0])
+	app.Spec.Components[0].ComponentTraits.Replicas = 3
+	app.Spec.Components[1].WorkloadType = SingletonServer
+	app.Spec.Components[1].ComponentTraits.Replicas = 2
+	app.Spec.Components[1].Version = "canary"
+	raw, _ := json.Marshal(app)
+	errs := enforced(policy.Evaluate("Application", "default", raw))
+	if len(errs) != 2 ||
+		errs[0].Field != "spec.components[1].componentTraits.replicas" ||
+		errs[1].Field != "spec.components[1].version" {
+		t.Errorf("unexpected errors %v", errs)
+	}
+
+	errs = enforced(policy.Evaluate("Deployment", "default", []byte(`{"metadata":{"labels":{}}}`)))
+	if len(errs) != 1 || errs[0].Field != "metadata.labels[app.kubernetes.io/part-of]" {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
+
+func TestPolicyCompileErrors(t *testing.T) {
+	for _, rules := range []string{
+		`rules: [{name: a, path: "spec.components[", required: true}]`,
+		`rules: [{name: a, path: spec.name, regex: "("}]`,
+		`rules: [{name: a, path: spec.name}]`,
+		`rules: [{name: a, path: spec.name, required: true}, {name: a, path: spec.kind, required: true}]`,
+	} {
+		var policy Policy
+		if err := yaml.Unmarshal([]byte(rules), &policy); err != nil {
+			t.Fatal(err)
+		}
+		if err := policy.compile(); err == nil {
+			t.Errorf("expected %s to be rejected", rules)
+		}
+	}
+}
+
+func TestPolicyCELRules(t *testing.T) {
+	const rules = `
+rules:
+- name: max-replicas
+  expression: object.spec.components.all(c, c.componentTraits.replicas <= 10)
+  message: components run at most 10 replicas
+- name: deployment-replicas
+  kinds: ["Deployment"]
+  expression: object.spec.replicas < 5
+`
+	var policy Policy
+	if err := yaml.Unmarshal([]byte(rules), &policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	app := validApplication()
+	raw, _ := json.Marshal(app)
+	if errs := enforced(policy.Evaluate("Application", "default", raw)); len(errs) != 0 {
+		t.Fatalf("expected valid application, got %v", errs)
+	}
+
+	app.Spec.Components[0].ComponentTraits.Replicas = 11
+	raw, _ = json.Marshal(app)
+	errs := enforced(policy.Evaluate("Application", "default", raw))
+	if len(errs) != 1 || !strings.Contains(errs[0].Detail, `components run at most 10 replicas (policy rule "max-replicas")`) {
+		t.Errorf("unexpected errors %v", errs)
+	}
+
+	errs = enforced(policy.Evaluate("Deployment", "default", []byte(`{"spec":{}}`)))
+	if len(errs) != 1 || !strings.Contains(errs[0].Detail, "could not be evaluated") {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
+
+func TestPolicyCELCompileErrors(t *testing.T) {
+	for _, rules := range []string{
+		`rules: [{name: broken, expression: "object.spec."}]`,
+		`rules: [{name: broken, expression: "object.spec.replicas + 1"}]`,
+		`rules: [{name: broken, expression: "1 + 1"}]`,
+		`rules: [{name: broken, expression: "true", path: spec.name}]`,
+	} {
+		var policy Policy
+		if err := yaml.Unmarshal([]byte(rules), &policy); err != nil {
+			t.Fatal(err)
+		}
+		err := policy.compile()
+		if err == nil || !strings.Contains(err.Error(), `rule "broken"`) {
+			t.Errorf("expected %s to be rejected with the rule name, got %v", rules, err)
+		}
+	}
+}
+
+func TestPolicyCELCostLimit(t *testing.T) {
+	const rules = `
+celCostLimit: 50
+rules:
+- name: first
+  expression: object.items.all(i, i < 1000)
+- name: second
+  expression: object.items.all(i, i < 1000)
+`
+	var policy Policy
+	if err := yaml.Unmarshal([]byte(rules), &policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	items := make([]int, 100)
+	raw, _ := json.Marshal(map[string]interface{}{"items": items})
+	errs := enforced(policy.Evaluate("Application", "default", raw))
+	if len(errs) != 2 {
+		t.Fatalf("expected both rules to exceed the cost limit, got %v", errs)
+	}
+	for _, err := range errs {
+		if !strings.Contains(err.Detail, "cost limit") {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+
+	// each rule fits in the limit on its own, but not both together
+	policy.CELCostLimit = 300
+	if err := policy.compile(); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ = json.Marshal(map[string]interface{}{"items": make([]int, 40)})
+	if errs := enforced(policy.Evaluate("Application", "default", raw)); len(errs) == 0 {
+		t.Errorf("expected the rules together to exceed the cost limit")
+	}
+	if errs := enforced(policy.Evaluate("Application", "default", []byte(`{"items":[1]}`))); len(errs) != 0 {
+		t.Errorf("expected cheap rules to pass, got %v", errs)
+	}
+}
+
+func TestPolicyModes(t *testing.T) {
+	const rules = `
+namespaceModes:
+  staging: audit
+rules:
+- name: version-format
+  path: spec.components[*].version
+  regex: ^v[0-9]+$
+  mode: warn
+  namespaceModes:
+    prod: enforce
+- name: ingress-path
+  path: spec.optTraits.ingress.path
+  enum: ["/"]
+`
+	var policy Policy
+	if err := yaml.Unmarshal([]byte(rules), &policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	app := validApplication()
+	app.Spec.Components[0].Version = "canary"
+	app.Spec.OptTraits.Ingress.Path = "/api"
+	raw, _ := json.Marshal(app)
+	for namespace, want := range map[string][]PolicyMode{
+		"dev":     {PolicyModeWarn, PolicyModeEnforce},
+		"prod":    {PolicyModeEnforce, PolicyModeEnforce},
+		"staging": {PolicyModeAudit, PolicyModeAudit},
+	} {
+		violations := policy.Evaluate("Application", namespace, raw)
+		if len(violations) != len(want) {
+			t.Fatalf("%s: unexpected violations %v", namespace, violations)
+		}
+		for i, v := range violations {
+			if v.Mode != want[i] {
+				t.Errorf("%s: expected rule %s in mode %s, got %s", namespace, v.Rule, want[i], v.Mode)
+			}
+		}
+	}
+
+	errs, warnings := splitViolations(policy.Evaluate("Application", "dev", raw))
+	if len(errs) != 1 || errs[0].Field != "spec.optTraits.ingress.path" ||
+		len(warnings) != 1 || !strings.Contains(warnings[0], "spec.components[0].version") {
+		t.Errorf("unexpected errors %v and warnings %v", errs, warnings)
+	}
+
+	for _, rules := range []string{
+		`rules: [{name: a, path: spec.name, required: true, mode: dryrun}]`,
+		`rules: [{name: a, path: spec.name, required: true, namespaceModes: {dev: dryrun}}]`,
+		`namespaceModes: {dev: dryrun}`,
+	} {
+		var policy Policy
+		if err := yaml.Unmarshal([]byte(rules), &policy); err != nil {
+			t.Fatal(err)
+		}
+		if err := policy.compile(); err == nil {
+			t.Errorf("expected %s to be rejected", rules)
+		}
+	}
+}
+
+func TestPolicyRouteTimeout(t *testing.T) {
+	var policy Policy
+	if err := yaml.Unmarshal([]byte(`routeTimeout: 15s`), &policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	app := validApplication()
+	app.Spec.OptTraits.HTTPRetry = &HTTPRetry{Attempts: 3, PerTryTimeout: "5s"}
+	if violations := policy.EvaluateRetries("default", app); len(violations) != 0 {
+		t.Fatalf("expected retries within the route timeout, got %v", violations)
+	}
+
+	app.Spec.OptTraits.HTTPRetry = &HTTPRetry{Attempts: 4, PerTryTimeout: "5s"}
+	violations := policy.EvaluateRetries("default", app)
+	if len(violations) != 1 || violations[0].Err.Field != "spec.optTraits.httpretry.attempts" ||
+		!strings.Contains(violations[0].Err.Detail, "4 attempts of 5s take longer than the route timeout of 15s, which fits 3") {
+		t.Errorf("unexpected violations %v", violations)
+	}
+
+	// the total of so many attempts overflows a time.Duration
+	app.Spec.OptTraits.HTTPRetry = &HTTPRetry{Attempts: math.MaxInt64 / 1000, PerTryTimeout: "10s"}
+	if violations := policy.EvaluateRetries("default", app); len(violations) != 1 {
+		t.Errorf("expected the attempts to exceed the route timeout, got %v", violations)
+	}
+
+	if err := yaml.Unmarshal([]byte(`routeTimeout: 15`), &policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.compile(); err == nil {
+		t.Error("expected an invalid route timeout to be rejected")
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// requestsGPU is the quota name of the extended resource requested for
+// CResource.Gpu.
+const requestsGPU corev1.ResourceName = "requests.nvidia.com/gpu"
+
+// quotaChecker compares the resources requested by Applications with the
+// headroom left by the ResourceQuotas of their namespace. The quotas and the
+// workloads of the namespace are read from informer caches. The usage in the
+// quota status only counts existing pods, so the pods that workloads are yet
+// to create are counted as used too.
+type quotaChecker struct {
+	quotas       corelisters.ResourceQuotaLister
+	deployments  appslisters.DeploymentLister
+	statefulSets appslisters.StatefulSetLister
+	daemonSets   appslisters.DaemonSetLister
+	synced       []cache.InformerSynced
+}
+
+// newQuotaChecker registers ResourceQuota and workload informers with
+// factory. The factory must be started before the checker is used.
+func newQuotaChecker(factory informers.SharedInformerFactory) *quotaChecker {
+	quotas := factory.Core().V1().ResourceQuotas()
+	deployments := factory.Apps().V1().Deployments()
+	statefulSets := factory.Apps().V1().StatefulSets()
+	daemonSets := factory.Apps().V1().DaemonSets()
+	return &quotaChecker{
+		quotas:       quotas.Lister(),
+		deployments:  deployments.Lister(),
+		statefulSets: statefulSets.Lister(),
+		daemonSets:   daemonSets.Lister(),
+		synced: []cache.InformerSynced{
+			quotas.Informer().HasSynced,
+			deployments.Informer().HasSynced,
+			statefulSets.Informer().HasSynced,
+			daemonSets.Informer().HasSynced,
+		},
+	}
+}
+
+func (qc *quotaChecker) hasSynced() bool {
+	for _, synced := range qc.synced {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
+
+// newInformerFactory returns an informer factory for client, which is a fake
+// clientset in tests.
+func newInformerFactory(client kubernetes.Interface) informers.SharedInformerFactory {
+	return informers.NewSharedInformerFactory(client, 0)
+}
+
+// Check returns an error for every quota of namespace whose headroom app
+// would exceed. The resources of old, the Application being replaced on
+// update, are already counted as used and are given back first.
+func (qc *quotaChecker) Check(namespace string, app, old *Application) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if qc == nil {
+		return allErrs
+	}
+	if !qc.hasSynced() {
+		glog.Warningf("ResourceQuota cache is not synced yet, skipping quota check for %s/%s", namespace, app.Name)
+		return allErrs
+	}
+	quotas, err := qc.quotas.ResourceQuotas(namespace).List(labels.Everything())
+	if err != nil {
+		return append(allErrs, field.InternalError(nil, err))
+	}
+	if len(quotas) == 0 {
+		return allErrs
+	}
+	pending, err := qc.pendingRequests(namespace)
+	if err != nil {
+		return append(allErrs, field.InternalError(nil, err))
+	}
+
+	requested := applicationRequests(app)
+	if old != nil {
+		for name, q := range applicationRequests(old) {
+			r := requested[name]
+			r.Sub(q)
+			requested[name] = r
+		}
+	}
+
+	sort.Slice(quotas, func(i, j int) bool { return quotas[i].Name < quotas[j].Name })
+	names := make([]string, 0, len(requested))
+	for name := range requested {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	for _, quota := range quotas {
+		for _, name := range names {
+			q := requested[corev1.ResourceName(name)]
+			if q.Sign() <= 0 {
+				continue
+			}
+			hard, ok := quota.Status.Hard[corev1.ResourceName(name)]
+			if !ok {
+				continue
+			}
+			used := quota.Status.Used[corev1.ResourceName(name)]
+			toCreate := pending[corev1.ResourceName(name)]
+			headroom := hard.DeepCopy()
+			headroom.Sub(used)
+			headroom.Sub(toCreate)
+			if q.Cmp(headroom) > 0 {
+				allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "components"),
+					fmt.Sprintf("requesting %s of %s exceeds the headroom of %s left by ResourceQuota %s (hard %s, used %s, pending %s)",
+						&q, name, &headroom, quota.Name, &hard, &used, &toCreate)))
+			}
+		}
+	}
+	return allErrs
+}
+
+// applicationRequests sums the resources requested by every container of app
+// times the replicas of its component, under the names ResourceQuotas use.
+func applicationRequests(app *Application) corev1.ResourceList {
+	requests := corev1.ResourceList{}
+	add := func(names []corev1.ResourceName, q resource.Quantity, replicas int64) {
+		for _, name := range names {
+			total := requests[name]
+			total.Add(scaleQuantity(q, replicas))
+			requests[name] = total
+		}
+	}
+	for _, com := range app.Spec.Components {
+		replicas := componentReplicas(&com)
+		for _, con := range com.Containers {
+			if cpu, err := resource.ParseQuantity(con.Resources.Cpu); err == nil {
+				add([]corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceRequestsCPU}, cpu, replicas)
+			}
+			if memory, err := resource.ParseQuantity(con.Resources.Memory); err == nil {
+				add([]corev1.ResourceName{corev1.ResourceMemory, corev1.ResourceRequestsMemory}, memory, replicas)
+			}
+			if con.Resources.Gpu > 0 {
+				add([]corev1.ResourceName{requestsGPU}, *resource.NewQuantity(int64(con.Resources.Gpu), resource.DecimalSI), replicas)
+			}
+			for _, v := range con.Resources.Volumes {
+				disk, err := resource.ParseQuantity(v.Disk.Required)
+				if err != nil {
+					continue
+				}
+				if v.Disk.Ephemeral {
+					add([]corev1.ResourceName{corev1.ResourceEphemeralStorage, corev1.ResourceRequestsEphemeralStorage}, disk, replicas)
+				} else {
+					add([]corev1.ResourceName{corev1.ResourceRequestsStorage}, disk, replicas)
+					add([]corev1.ResourceName{corev1.ResourcePersistentVolumeClaims}, *resource.NewQuantity(1, resource.DecimalSI), replicas)
+				}
+			}
+		}
+	}
+	return requests
+}
+
+// pendingRequests sums the requests of the pods that the Deployments,
+// StatefulSets and DaemonSets of namespace are yet to create, under the names
+// ResourceQuotas use.
+func (qc *quotaChecker) pendingRequests(namespace string) (corev1.ResourceList, error) {
+	pending := corev1.ResourceList{}
+	add := func(spec *corev1.PodSpec, missing int32) {
+		if missing <= 0 {
+			return
+		}
+		for name, q := range podRequests(spec) {
+			total := pending[name]
+			total.Add(scaleQuantity(q, int64(missing)))
+			pending[name] = total
+		}
+	}
+	deployments, err := qc.deployments.Deployments(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range deployments {
+		add(&d.Spec.Template.Spec, desiredReplicas(d.Spec.Replicas)-d.Status.Replicas)
+	}
+	statefulSets, err := qc.statefulSets.StatefulSets(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range statefulSets {
+		add(&s.Spec.Template.Spec, desiredReplicas(s.Spec.Replicas)-s.Status.Replicas)
+	}
+	daemonSets, err := qc.daemonSets.DaemonSets(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range daemonSets {
+		add(&d.Spec.Template.Spec, d.Status.DesiredNumberScheduled-d.Status.CurrentNumberScheduled)
+	}
+	return pending, nil
+}
+
+// desiredReplicas is the replicas of a workload, which default to one.
+func desiredReplicas(replicas *int32) int32 {
+	if replicas == nil {
+		return 1
+	}
+	return *replicas
+}
+
+// podRequests returns the requests of a pod under the names ResourceQuotas
+// use. A pod requests the sum over its containers, or the most of any init
+// container if that is more.
+func podRequests(spec *corev1.PodSpec) corev1.ResourceList {
+	requests := corev1.ResourceList{}
+	for _, con := range spec.Containers {
+		for name, q := range con.Resources.Requests {
+			total := requests[name]
+			total.Add(q)
+			requests[name] = total
+		}
+	}
+	for _, con := range spec.InitContainers {
+		for name, q := range con.Resources.Requests {
+			if q.Cmp(requests[name]) > 0 {
+				requests[name] = q.DeepCopy()
+			}
+		}
+	}
+	quotaRequests := corev1.ResourceList{}
+	for name, q := range requests {
+		quotaRequests[corev1.ResourceName("requests."+string(name))] = q
+		switch name {
+		case corev1.ResourceCPU, corev1.ResourceMemory, corev1.ResourceEphemeralStorage:
+			quotaRequests[name] = q
+		}
+	}
+	return quotaRequests
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newFakeQuotaChecker(t *testing.T, objects ...runtime.Object) *quotaChecker {
+	t.Helper()
+	client := fake.NewSimpleClientset(objects...)
+	factory := newInformerFactory(client)
+	qc := newQuotaChecker(factory)
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	factory.Start(stop)
+	factory.WaitForCacheSync(stop)
+	return qc
+}
+
+func TestQuotaCheck(t *testing.T) {
+	quota := &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "compute", Namespace: "default"},
+		Status: corev1.ResourceQuotaStatus{
+			Hard: corev1.ResourceList{
+				corev1.ResourceRequestsCPU:     resource.MustParse("4"),
+				corev1.ResourceRequestsMemory:  resource.MustParse("8Gi"),
+				requestsGPU:                    resource.MustParse("8"),
+				corev1.ResourceRequestsStorage: resource.MustParse("100Gi"),
+			},
+			Used: corev1.ResourceList{
+				corev1.ResourceRequestsCPU:    resource.MustParse("2"),
+				corev1.ResourceRequestsMemory: resource.MustParse("2Gi"),
+				requestsGPU:                   resource.MustParse("6"),
+			},
+		},
+	}
+	qc := newFakeQuotaChecker(t, quota)
+
+	app := validApplication()
+	app.Spec.Components[0].Containers[0].Resources = CResource{
+		Cpu:     "500m",
+		Memory:  "1Gi",
+		Gpu:     1,
+		Volumes: []CVolume{{Name: "data", MountPath: "/data", Disk: Disk{Required: "10Gi"}}},
+	}
+	app.Spec.Components[0].ComponentTraits.Replicas = 2
+	if errs := qc.Check("default", app, nil); len(errs) != 0 {
+		t.Fatalf("expected application within the headroom, got %v", errs)
+	}
+	if errs := qc.Check("other", app, nil); len(errs) != 0 {
+		t.Fatalf("expected no quota in other namespaces, got %v", errs)
+	}
+
+	app.Spec.Components[0].ComponentTraits.Autoscaling = &Autoscaling{Metric: "cpu", Threshold: 80, MinReplicas: 2, MaxReplicas: 6}
+	errs := qc.Check("default", app, nil)
+	want := []string{"3 of requests.cpu", "6 of requests.nvidia.com/gpu"}
+	if len(errs) != len(want) {
+		t.Fatalf("expected %d errors, got %v", len(want), errs)
+	}
+	for i, err := range errs {
+		if !strings.Contains(err.Detail, want[i]) || !strings.Contains(err.Detail, "ResourceQuota compute") {
+			t.Errorf("expected an error about %s, got %v", want[i], err)
+		}
+	}
+
+	// on update the resources of the old application are already used
+	old := validApplication()
+	old.Spec.Components[0].Containers[0].Resources = CResource{Cpu: "1", Gpu: 3}
+	old.Spec.Components[0].ComponentTraits.Replicas = 2
+	if errs := qc.Check("default", app, old); len(errs) != 0 {
+		t.Errorf("expected the old resources to be given back, got %v", errs)
+	}
+
+	// quantities too large for milli-values must not wrap around and skip
+	// the check
+	app = validApplication()
+	app.Spec.Components[0].Containers[0].Resources = CResource{Cpu: "500m", Memory: "8Ei"}
+	app.Spec.Components[0].ComponentTraits.Replicas = 3
+	if errs := qc.Check("default", app, nil); len(errs) != 1 || !strings.Contains(errs[0].Detail, "of requests.memory exceeds") {
+		t.Errorf("expected the memory to exceed the headroom, got %v", errs)
+	}
+
+	var disabled *quotaChecker
+	if errs := disabled.Check("default", app, nil); len(errs) != 0 {
+		t.Errorf("expected no errors without a checker, got %v", errs)
+	}
+}
+
+func TestQuotaCheckPendingWorkloads(t *testing.T) {
+	quota := &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "compute", Namespace: "default"},
+		Status: corev1.ResourceQuotaStatus{
+			Hard: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("4")},
+			Used: corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("1")},
+		},
+	}
+	replicas := int32(3)
+	template := corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+		InitContainers: []corev1.Container{{Name: "init", Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")},
+		}}},
+		Containers: []corev1.Container{{Name: "web", Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m")},
+		}}},
+	}}
+	// the deployment has created one of its three pods, which is in the
+	// quota usage already
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas, Template: template},
+		Status:     appsv1.DeploymentStatus{Replicas: 1},
+	}
+	daemonSet := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "default"},
+		Spec:       appsv1.DaemonSetSpec{Template: template},
+		Status:     appsv1.DaemonSetStatus{DesiredNumberScheduled: 2, CurrentNumberScheduled: 2},
+	}
+	qc := newFakeQuotaChecker(t, quota, deployment, daemonSet)
+
+	pending, err := qc.pendingRequests("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := pending[corev1.ResourceRequestsCPU]; q.Cmp(resource.MustParse("1")) != 0 {
+		t.Errorf("expected 1 CPU pending, got %s", &q)
+	}
+
+	app := validApplication()
+	app.Spec.Components[0].Containers[0].Resources = CResource{Cpu: "1"}
+	app.Spec.Components[0].ComponentTraits.Replicas = 2
+	if errs := qc.Check("default", app, nil); len(errs) != 0 {
+		t.Fatalf("expected application within the headroom, got %v", errs)
+	}
+	app.Spec.Components[0].ComponentTraits.Replicas = 3
+	errs := qc.Check("default", app, nil)
+	if len(errs) != 1 || !strings.Contains(errs[0].Detail, "headroom of 2 left by ResourceQuota compute (hard 4, used 1, pending 1)") {
+		t.Errorf("expected the pending pods to reduce the headroom, got %v", errs)
+	}
+}
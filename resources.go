@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+
+	"gopkg.in/inf.v0"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// resourcePolicyRule is the rule name reported for resource policy
+// violations.
+const resourcePolicyRule = "resources"
+
+// ResourcePolicy bounds the CPU and memory of the containers of an
+// Application. Namespaces override the rules for Applications in a namespace,
+// field by field.
+type ResourcePolicy struct {
+	ResourceRules `json:",inline"`
+	Namespaces    map[string]ResourceRules `json:"namespaces,omitempty"`
+}
+
+// ResourceRules are the bounds applied to the resources of every container
+// and to the Application as a whole. Unset bounds are not checked.
+type ResourceRules struct {
+	MinCPU    *resource.Quantity `json:"minCpu,omitempty"`
+	MaxCPU    *resource.Quantity `json:"maxCpu,omitempty"`
+	MinMemory *resource.Quantity `json:"minMemory,omitempty"`
+	MaxMemory *resource.Quantity `json:"maxMemory,omitempty"`
+	// MaxMemoryPerCPU bounds the memory of a container per CPU core
+	MaxMemoryPerCPU *resource.Quantity `json:"maxMemoryPerCpu,omitempty"`
+	// BudgetCPU and BudgetMemory bound the sum over all containers of their
+	// resources times the replicas of their component, or the maximum
+	// replicas if the component is autoscaled
+	BudgetCPU    *resource.Quantity `json:"budgetCpu,omitempty"`
+	BudgetMemory *resource.Quantity `json:"budgetMemory,omitempty"`
+	// Mode of the resource checks, the namespace mode of the policy or
+	// enforce if empty
+	Mode PolicyMode `json:"mode,omitempty"`
+}
+
+// rules merges the overrides of namespace into the default rules.
+func (rp *ResourcePolicy) rules(namespace string) ResourceRules {
+	rules := rp.ResourceRules
+	override, ok := rp.Namespaces[namespace]
+	if !ok {
+		return rules
+	}
+	for _, q := range []struct{ to, from **resource.Quantity }{
+		{&rules.MinCPU, &override.MinCPU},
+		{&rules.MaxCPU, &override.MaxCPU},
+		{&rules.MinMemory, &override.MinMemory},
+		{&rules.MaxMemory, &override.MaxMemory},
+		{&rules.MaxMemoryPerCPU, &override.MaxMemoryPerCPU},
+		{&rules.BudgetCPU, &override.BudgetCPU},
+		{&rules.BudgetMemory, &override.BudgetMemory},
+	} {
+		if *q.from != nil {
+			*q.to = *q.from
+		}
+	}
+	if override.Mode != "" {
+		rules.Mode = override.Mode
+	}
+	return rules
+}
+
+func (rp *ResourcePolicy) validate() error {
+	if err := validateResourceRules(rp.rules("")); err != nil {
+		return err
+	}
+	for namespace := range rp.Namespaces {
+		if err := validateResourceRules(rp.rules(namespace)); err != nil {
+			return fmt.Errorf("namespace %q: %v", namespace, err)
+		}
+	}
+	return nil
+}
+
+// validateResourceRules checks the rules in effect for a namespace, after
+// the overrides are merged.
+func validateResourceRules(rules ResourceRules) error {
+	if rules.MinCPU != nil && rules.MaxCPU != nil && rules.MinCPU.Cmp(*rules.MaxCPU) > 0 {
+		return fmt.Errorf("minCpu %s is greater than maxCpu %s", rules.MinCPU, rules.MaxCPU)
+	}
+	if rules.MinMemory != nil && rules.MaxMemory != nil && rules.MinMemory.Cmp(*rules.MaxMemory) > 0 {
+		return fmt.Errorf("minMemory %s is greater than maxMemory %s", rules.MinMemory, rules.MaxMemory)
+	}
+	return validateMode(rules.Mode)
+}
+
+// EvaluateResources checks the resources of app against the resource policy
+// for namespace.
+func (p *Policy) EvaluateResources(namespace string, app *Application) []PolicyViolation {
+	var violations []PolicyViolation
+	if p == nil || p.Resources == nil {
+		return violations
+	}
+	rules := p.Resources.rules(namespace)
+	mode := p.sectionMode(rules.Mode, namespace)
+	for _, err := range rules.check(app) {
+		violations = append(violations, PolicyViolation{Rule: resourcePolicyRule, Mode: mode, Err: err})
+	}
+	return violations
+}
+
+func (rules *ResourceRules) check(app *Application) field.ErrorList {
+	allErrs := field.ErrorList{}
+	totalCPU, totalMemory := resource.Quantity{}, resource.Quantity{}
+	componentsPath := field.NewPath("spec", "components")
+	for i, com := range app.Spec.Components {
+		replicas := componentReplicas(&com)
+		for j, con := range com.Containers {
+			resourcesPath := componentsPath.Index(i).Child("containers").Index(j).Child("resources")
+			// malformed quantities are reported by Validation
+			cpu, cpuErr := resource.ParseQuantity(con.Resources.Cpu)
+			memory, memoryErr := resource.ParseQuantity(con.Resources.Memory)
+			if cpuErr == nil {
+				allErrs = append(allErrs, checkQuantityBounds(con.Resources.Cpu, cpu, rules.MinCPU, rules.MaxCPU, resourcesPath.Child("cpu"))...)
+				totalCPU.Add(scaleQuantity(cpu, replicas))
+			}
+			if memoryErr == nil {
+				allErrs = append(allErrs, checkQuantityBounds(con.Resources.Memory, memory, rules.MinMemory, rules.MaxMemory, resourcesPath.Child("memory"))...)
+				totalMemory.Add(scaleQuantity(memory, replicas))
+			}
+			if cpuErr == nil && memoryErr == nil && rules.MaxMemoryPerCPU != nil && cpu.Sign() > 0 {
+				ratio := new(inf.Dec).QuoRound(memory.AsDec(), cpu.AsDec(), 0, inf.RoundDown)
+				perCPU := resource.NewDecimalQuantity(*ratio, resource.BinarySI)
+				if perCPU.Cmp(*rules.MaxMemoryPerCPU) > 0 {
+					allErrs = append(allErrs, field.Invalid(resourcesPath.Child("memory"), con.Resources.Memory,
+						fmt.Sprintf("%s of memory per CPU exceeds the maximum of %s", perCPU, rules.MaxMemoryPerCPU)))
+				}
+			}
+		}
+	}
+	if rules.BudgetCPU != nil && totalCPU.Cmp(*rules.BudgetCPU) > 0 {
+		allErrs = append(allErrs, field.Forbidden(componentsPath,
+			fmt.Sprintf("the application requests %s CPU over all replicas, exceeding the budget of %s", &totalCPU, rules.BudgetCPU)))
+	}
+	if rules.BudgetMemory != nil && totalMemory.Cmp(*rules.BudgetMemory) > 0 {
+		allErrs = append(allErrs, field.Forbidden(componentsPath,
+			fmt.Sprintf("the application requests %s of memory over all replicas, exceeding the budget of %s", &totalMemory, rules.BudgetMemory)))
+	}
+	return allErrs
+}
+
+// componentReplicas is the number of replicas com may run, the maximum
+// replicas if it is autoscaled.
+func componentReplicas(com *Component) int64 {
+	replicas := int64(com.ComponentTraits.Replicas)
+	if as := com.ComponentTraits.Autoscaling; as != nil && int64(as.MaxReplicas) > replicas {
+		replicas = int64(as.MaxReplicas)
+	}
+	return replicas
+}
+
+// scaleQuantity returns q times n. It multiplies decimals rather than
+// milli-values so that large quantities such as 8Ei do not wrap around.
+func scaleQuantity(q resource.Quantity, n int64) resource.Quantity {
+	scaled := new(inf.Dec).Mul(q.AsDec(), inf.NewDec(n, 0))
+	return *resource.NewDecimalQuantity(*scaled, q.Format)
+}
+
+func checkQuantityBounds(value string, q resource.Quantity, min, max *resource.Quantity, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if min != nil && q.Cmp(*min) < 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath, value, fmt.Sprintf("must be greater than or equal to %s", min)))
+	}
+	if max != nil && q.Cmp(*max) > 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath, value, fmt.Sprintf("must be less than or equal to %s", max)))
+	}
+	return allErrs
+}
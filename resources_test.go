@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+)
+
+func TestEvaluateResources(t *testing.T) {
+	const rules = `
+resources:
+  minCpu: 10m
+  maxCpu: "2"
+  maxMemory: 4Gi
+  maxMemoryPerCpu: 2Gi
+  budgetCpu: "4"
+  budgetMemory: 8Gi
+  namespaces:
+    batch:
+      maxCpu: "8"
+      budgetCpu: "16"
+`
+	var policy Policy
+	if err := yaml.Unmarshal([]byte(rules), &policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	app := validApplication()
+	app.Spec.Components[0].Containers[0].Resources = CResource{Cpu: "0.5", Memory: "512Mi"}
+	app.Spec.Components[0].ComponentTraits.Replicas = 4
+	if violations := policy.EvaluateResources("default", app); len(violations) != 0 {
+		t.Fatalf("expected resources within bounds, got %v", violations)
+	}
+
+	app.Spec.Components[0].Containers[0].Resources = CResource{Cpu: "4", Memory: "3Gi"}
+	want := []string{
+		"spec.components[0].containers[0].resources.cpu: Invalid value: \"4\": must be less than or equal to 2",
+		"the application requests 16 CPU over all replicas, exceeding the budget of 4",
+		"the application requests 12Gi of memory over all replicas, exceeding the budget of 8Gi",
+	}
+	violations := policy.EvaluateResources("default", app)
+	if len(violations) != len(want) {
+		t.Fatalf("expected %d violations, got %v", len(want), violations)
+	}
+	for i, v := range violations {
+		if !strings.Contains(v.Err.Error(), want[i]) {
+			t.Errorf("expected %q, got %v", want[i], v.Err)
+		}
+	}
+
+	app.Spec.Components[0].Containers[0].Resources = CResource{Cpu: "100m", Memory: "1Gi"}
+	violations = policy.EvaluateResources("default", app)
+	if len(violations) != 1 || !strings.Contains(violations[0].Err.Detail, "10Gi of memory per CPU exceeds the maximum of 2Gi") {
+		t.Errorf("expected the memory to CPU ratio to be exceeded, got %v", violations)
+	}
+
+	// quantities too large for milli-values must not wrap around below the
+	// bounds
+	app.Spec.Components[0].Containers[0].Resources = CResource{Cpu: "1", Memory: "8Ei"}
+	want = []string{
+		"spec.components[0].containers[0].resources.memory: Invalid value: \"8Ei\": must be less than or equal to 4Gi",
+		"of memory per CPU exceeds the maximum of 2Gi",
+		"of memory over all replicas, exceeding the budget of 8Gi",
+	}
+	violations = policy.EvaluateResources("default", app)
+	if len(violations) != len(want) {
+		t.Fatalf("expected %d violations, got %v", len(want), violations)
+	}
+	for i, v := range violations {
+		if !strings.Contains(v.Err.Error(), want[i]) {
+			t.Errorf("expected %q, got %v", want[i], v.Err)
+		}
+	}
+
+	app.Spec.Components[0].Containers[0].Resources = CResource{Cpu: "4", Memory: "2Gi"}
+	app.Spec.Components[0].ComponentTraits.Autoscaling = &Autoscaling{Metric: "cpu", Threshold: 80, MinReplicas: 1, MaxReplicas: 4}
+	app.Spec.Components[0].ComponentTraits.Replicas = 1
+	if violations := policy.EvaluateResources("batch", app); len(violations) != 0 {
+		t.Errorf("expected the batch overrides to apply, got %v", violations)
+	}
+
+	for _, rules := range []string{
+		`resources: {minCpu: "2", maxCpu: "1"}`,
+		`resources: {maxMemory: 1Gi, namespaces: {dev: {minMemory: 2Gi}}}`,
+		`resources: {mode: dryrun}`,
+	} {
+		var policy Policy
+		if err := yaml.Unmarshal([]byte(rules), &policy); err != nil {
+			t.Fatal(err)
+		}
+		if err := policy.compile(); err == nil {
+			t.Errorf("expected %s to be rejected", rules)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// sidecarTemplateData is the data the sidecar configuration is rendered with,
+// e.g. `{{ .ObjectMeta.Labels "app.kubernetes.io/name" }}`.
+type sidecarTemplateData struct {
+	ObjectMeta sidecarTemplateMeta
+	Spec       corev1.PodSpec
+	// ContainerPorts lists the ports of every container in the Pod
+	ContainerPorts []corev1.ContainerPort
+}
+
+type sidecarTemplateMeta struct {
+	Name         string
+	GenerateName string
+	Namespace    string
+
+	labels      map[string]string
+	annotations map[string]string
+}
+
+// Labels returns the value of the Pod label key, or "" if it is not set.
+func (m sidecarTemplateMeta) Labels(key string) string {
+	return m.labels[key]
+}
+
+// Annotations returns the value of the Pod annotation key, or "" if it is not set.
+func (m sidecarTemplateMeta) Annotations(key string) string {
+	return m.annotations[key]
+}
+
+func newSidecarTemplateData(pod *corev1.Pod) *sidecarTemplateData {
+	data := &sidecarTemplateData{
+		ObjectMeta: sidecarTemplateMeta{
+			Name:         pod.Name,
+			GenerateName: pod.GenerateName,
+			Namespace:    pod.Namespace,
+			labels:       pod.Labels,
+			annotations:  pod.Annotations,
+		},
+		Spec: pod.Spec,
+	}
+	for _, c := range pod.Spec.Containers {
+		data.ContainerPorts = append(data.ContainerPorts, c.Ports...)
+	}
+	return data
+}
+
+// renderStrings executes every string reachable from v that contains a
+// template action, e.g. the image of a container, and stores the result in
+// place. Map keys and unexported fields are left as they are.
+func renderStrings(v reflect.Value, data *sidecarTemplateData) error {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			return renderStrings(v.Elem(), data)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				if err := renderStrings(v.Field(i), data); err != nil {
+					return err
+				}
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := renderStrings(v.Index(i), data); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			// map values are not addressable, render a copy and store it back
+			value := reflect.New(iter.Value().Type()).Elem()
+			value.Set(iter.Value())
+			if err := renderStrings(value, data); err != nil {
+				return err
+			}
+			v.SetMapIndex(iter.Key(), value)
+		}
+	case reflect.String:
+		if !v.CanSet() || !strings.Contains(v.String(), "{{") {
+			return nil
+		}
+		tmpl, err := template.New("").Parse(v.String())
+		if err != nil {
+			return err
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			return err
+		}
+		v.SetString(b.String())
+	}
+	return nil
+}
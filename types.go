@@ -1,7 +1,6 @@
 package main
 
 import (
-	"github.com/rancher/norman/types"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -20,7 +19,7 @@ const (
 	Worker          WorkloadType = "Worker"
 	SingletonWorker WorkloadType = "SingletonWorker"
 	Task            WorkloadType = "Task"
-	SingletonTask   WorkloadType = "SingletonTaskTask"
+	SingletonTask   WorkloadType = "SingletonTask"
 )
 
 // +genclient
@@ -29,7 +28,7 @@ const (
 // Application is a specification for a Application resource
 
 type Application struct {
-	types.Namespaced
+	Namespaced
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
@@ -37,6 +36,11 @@ type Application struct {
 	Status ApplicationStatus `json:"status,omitempty"`
 }
 
+// Namespaced marks a type as a namespaced resource, like the marker of the
+// same name in rancher/norman. It has no fields and does not change the JSON
+// encoding.
+type Namespaced struct{}
+
 type ApplicationSpec struct {
 	Components []Component `json:"components"`
 	//DevTraits  ComponentTraitsForDev `json:"devTraits,omitempty"`
@@ -75,7 +79,7 @@ type ComponentTraitsForOpt struct {
 
 //zk
 type CustomMetric struct {
-	Enable bool   `json: "enable"`
+	Enable bool   `json:"enable"`
 	Uri    string `json:"uri,omitempty"`
 }
 
@@ -88,7 +92,7 @@ type Autoscaling struct {
 
 type HTTPRetry struct {
 	Attempts      int    `json:"attempts"`
-	PerTryTimeout string `json: "perTryTimeout"`
+	PerTryTimeout string `json:"perTryTimeout"`
 }
 
 //zk
@@ -355,7 +359,7 @@ type Handler struct {
 }
 
 type HealthProbe struct {
-	Handler             `json:haneler",inline" protobuf:"bytes,1,opt,name=handler"`
+	Handler             `json:",inline" protobuf:"bytes,1,opt,name=handler"`
 	InitialDelaySeconds int32 `json:"initialDelaySeconds,omitempty" protobuf:"varint,2,opt,name=initialDelaySeconds"`
 
 	TimeoutSeconds int32 `json:"timeoutSeconds,omitempty" protobuf:"varint,3,opt,name=timeoutSeconds"`
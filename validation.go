@@ -4,348 +4,693 @@ import (
 	"fmt"
 	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/distribution/reference"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http/httpguts"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 )
 
-func (app *Application) Validation() error {
+var (
+	configPathRegexp = regexp.MustCompile(`^\/(\w+\/?)+$`)
+	userRegexp       = regexp.MustCompile(`^.*@.*$`)
+)
+
+// Validation checks the whole application and returns every problem found,
+// each one carrying the JSON path of the offending field.
+func (app *Application) Validation() field.ErrorList {
 	log.Infoln("START Validation")
-	if app.Name == "" {
-		return fmt.Errorf("Please input application name.")
-	}
-	matched, err := regexp.MatchString(`^[a-z]([-a-z0-9]*[a-z0-9])?`, app.Name)
-	if err != nil {
-		return fmt.Errorf("Regexp application.name failed, ErrorInfo is %s", err)
-	}
-	if !matched {
-		return fmt.Errorf("Application name %s is invalid a DNS-1035 label must consist of lower case alphanumeric characters or '-', start with an alphabetic character, and end with an alphanumeric character (e.g. 'my-name',  or 'abc-123', regex used for validation is '[a-z]([-a-z0-9]*[a-z0-9])?'", app.Name)
-	}
+	allErrs := field.ErrorList{}
+
+	allErrs = append(allErrs, validateDNS1035Label(app.Name, field.NewPath("metadata", "name"))...)
 	/*if _, ok := app.Labels["projectId"]; !ok {
 		return fmt.Errorf("projectId not in Application Labels,Please add it.")
 	}*/
+	// a malformed annotation is reported by validateApplicationParameters
+	supplied, _ := applicationParameters(app)
+	componentsPath := field.NewPath("spec", "components")
 	var componentname string
+	var workloadType WorkloadType
 	var componentversion map[string]int = make(map[string]int)
-	for _, com := range app.Spec.Components {
-		if com.Name == "" {
-			return fmt.Errorf("Component.name can't be empty")
-		}
-		matched, err := regexp.MatchString(`^[a-z]([-a-z0-9]*[a-z0-9])?`, com.Name)
-		if err != nil {
-			return fmt.Errorf("Regexp application.name failed, ErrorInfo is %s", err)
-		}
-		if !matched {
-			return fmt.Errorf("Component name %s is invalid a DNS-1035 label must consist of lower case alphanumeric characters or '-', start with an alphabetic character, and end with an alphanumeric character (e.g. 'my-name',  or 'abc-123', regex used for validation is '[a-z]([-a-z0-9]*[a-z0-9])?'", com.Name)
-		}
+	for i, com := range app.Spec.Components {
+		comPath := componentsPath.Index(i)
+		allErrs = append(allErrs, validateDNS1035Label(com.Name, comPath.Child("name"))...)
 		if componentname == "" {
 			componentname = com.Name
-		} else {
-			if componentname != com.Name {
-				return fmt.Errorf("If the application has multiple components their names must be the same")
-			}
+		} else if componentname != com.Name {
+			allErrs = append(allErrs, field.Invalid(comPath.Child("name"), com.Name, "if the application has multiple components their names must be the same"))
 		}
-		if com.WorkloadType != "Server" {
-			return fmt.Errorf("WorkloadType Need be Server.")
+		if workloadType == "" {
+			workloadType = com.WorkloadType
+		} else if workloadType != com.WorkloadType {
+			allErrs = append(allErrs, field.Invalid(comPath.Child("workloadType"), com.WorkloadType, "if the application has multiple components their workload types must be the same"))
 		}
 		if com.Version == "" {
-			return fmt.Errorf("Please specify the version.")
-		}
-		if _, ok := componentversion[com.Version]; ok {
-			fmt.Errorf("The same component must have different versions")
+			allErrs = append(allErrs, field.Required(comPath.Child("version"), "please specify the version"))
+		} else if _, ok := componentversion[com.Version]; ok {
+			allErrs = append(allErrs, field.Duplicate(comPath.Child("version"), com.Version))
 		} else {
 			componentversion[com.Version] = 1
 		}
+		allErrs = append(allErrs, validateComponent(&com, resolveParameters(&com, supplied), comPath)...)
+	}
+	allErrs = append(allErrs, validateApplicationParameters(app)...)
+	allErrs = append(allErrs, validateOptTraits(&app.Spec.OptTraits, workloadType, field.NewPath("spec", "optTraits"))...)
+	var versions []string
+	var ports []AppPort
+	for _, com := range app.Spec.Components {
+		if com.Version != "" {
+			versions = append(versions, com.Version)
+		}
 		for _, con := range com.Containers {
-			if con.Name == "" {
-				return fmt.Errorf("Please specify the %s's container name.", con.Name)
-			}
-			matched, err := regexp.MatchString(`^[a-z]([-a-z0-9]*[a-z0-9])?`, con.Name)
-			if err != nil {
-				return fmt.Errorf("Regexp application.compenent.container.name failed, ErrorInfo is %s", err)
-			}
-			if !matched {
-				return fmt.Errorf("Component.container.name %s is invalid a DNS-1035 label must consist of lower case alphanumeric characters or '-', start with an alphabetic character, and end with an alphanumeric character (e.g. 'my-name',  or 'abc-123', regex used for validation is '[a-z]([-a-z0-9]*[a-z0-9])?'", con.Name)
-			}
-			if len(con.Env) != 0 {
-				for _, env := range con.Env {
-					if env.Name == "" {
-						return fmt.Errorf("Env name can't be empty")
-					}
-					if env.Value == "" && env.FromParam == "" {
-						return fmt.Errorf("If Env.Name not be empty,Env's Value or FromParam can't be empty")
-					}
-					if env.Value != "" && env.FromParam != "" {
-						return fmt.Errorf("env.value and env.fromparam cannot be configured at the same time")
-					}
-
-					if env.FromParam != "" && !(env.FromParam == "spec.nodeName" || env.FromParam == "metadata.name" || env.FromParam == "metadata.namespace" || env.FromParam == "status.podIP") {
-						return fmt.Errorf("Only these fields are allowed to be populated fromparam(spec.nodeName,metadata.name,metadata.namespace,status.podIP)")
-					}
+			ports = append(ports, con.Ports...)
+		}
+	}
+	allErrs = append(allErrs, validateGrayRelease(app.Spec.OptTraits.GrayRelease, versions, field.NewPath("spec", "optTraits", "grayRelease"))...)
+	if cb := app.Spec.OptTraits.CircuitBreaking; cb != nil {
+		allErrs = append(allErrs, validatePortLevelSettings(cb.PortLevelSettings, ports, field.NewPath("spec", "optTraits", "circuitbreaking", "portLevelSettings"))...)
+	}
+	return allErrs
+}
 
-				}
+// ValidationUpdate checks the changes made to old. The name of the
+// application and of its components cannot change, a version cannot be
+// redeployed with another image, the ingress host only changes when the new
+// host is acknowledged in an annotation and the last component cannot be
+// removed.
+func (app *Application) ValidationUpdate(old *Application) field.ErrorList {
+	log.Infoln("START ValidationUpdate")
+	allErrs := field.ErrorList{}
+
+	if app.Name != old.Name {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("metadata", "name"), app.Name, "field is immutable"))
+	}
+
+	componentsPath := field.NewPath("spec", "components")
+	if len(old.Spec.Components) != 0 && len(app.Spec.Components) == 0 {
+		allErrs = append(allErrs, field.Forbidden(componentsPath, "cannot remove the last component"))
+	}
+	oldImages := map[string]map[string]string{}
+	var oldName string
+	for _, com := range old.Spec.Components {
+		if oldName == "" {
+			oldName = com.Name
+		}
+		images := map[string]string{}
+		for _, con := range com.Containers {
+			images[con.Name] = con.Image
+		}
+		oldImages[com.Version] = images
+	}
+	for i, com := range app.Spec.Components {
+		comPath := componentsPath.Index(i)
+		if oldName != "" && com.Name != oldName {
+			allErrs = append(allErrs, field.Invalid(comPath.Child("name"), com.Name, "field is immutable"))
+		}
+		images, ok := oldImages[com.Version]
+		if !ok {
+			continue
+		}
+		for j, con := range com.Containers {
+			if image, ok := images[con.Name]; ok && image != con.Image {
+				allErrs = append(allErrs, field.Invalid(comPath.Child("containers").Index(j).Child("image"), con.Image,
+					fmt.Sprintf("version %s was deployed with image %s, use a new version to change the image", com.Version, image)))
 			}
-			if len(con.Config) != 0 {
-				for _, v := range con.Config {
-					if v.Path == "" || v.Value == "" || v.FileName == "" {
-						return fmt.Errorf("application.components.container.config's path 、value、filename can't be empty at the same time")
-					}
-					matched, err := regexp.MatchString(`^\/(\w+\/?)+$`, v.Path)
-					if err != nil {
-						return fmt.Errorf("Regexp application.components.containers.config.path's failed, ErrorInfo is %s", err)
-					}
-					if !matched {
-						return fmt.Errorf("application.components.containers.config.path's syntax is err")
-					}
+		}
+	}
+
+	host, oldHost := app.Spec.OptTraits.Ingress.Host, old.Spec.OptTraits.Ingress.Host
+	if oldHost != "" && host != oldHost && app.Annotations[admissionWebhookAnnotationIngressHostKey] != host {
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "optTraits", "ingress", "host"),
+			fmt.Sprintf("changing the host from %s requires the annotation %s: %s", oldHost, admissionWebhookAnnotationIngressHostKey, host)))
+	}
+	return allErrs
+}
+
+// validateComponent checks com. params are the resolved values of its
+// parameters, which references with fromParam are checked against.
+func validateComponent(com *Component, params map[string]string, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if com.WorkloadType == "" {
+		allErrs = append(allErrs, field.Required(fldPath.Child("workloadType"), ""))
+	}
+	for i, con := range com.Containers {
+		conPath := fldPath.Child("containers").Index(i)
+		allErrs = append(allErrs, validateContainer(&con, params, conPath)...)
+		if !isExposedWorkload(com.WorkloadType) && len(con.Ports) != 0 {
+			allErrs = append(allErrs, field.Forbidden(conPath.Child("ports"), fmt.Sprintf("%s workloads cannot expose ports", com.WorkloadType)))
+		}
+		if isTaskWorkload(com.WorkloadType) && con.ReadinessProbe != nil {
+			allErrs = append(allErrs, field.Forbidden(conPath.Child("readinessProbe"), fmt.Sprintf("%s workloads run to completion and do not receive traffic", com.WorkloadType)))
+		}
+	}
+	for i, setting := range com.WorkloadSettings {
+		if setting.Name != "restartPolicy" {
+			continue
+		}
+		settingPath := fldPath.Child("workloadSetings").Index(i)
+		value, valuePath := setting.Value, settingPath.Child("value")
+		if setting.FromParam != "" {
+			var ok bool
+			valuePath = settingPath.Child("fromParam")
+			if value, ok = params[setting.FromParam]; !ok {
+				// undeclared and required parameters are reported by
+				// validateApplicationParameters
+				if param := findParameter(com.Parameters, setting.FromParam); param != nil && !param.Required {
+					allErrs = append(allErrs, field.Required(valuePath,
+						fmt.Sprintf("parameter %s needs a default or a supplied value to set the restart policy", setting.FromParam)))
 				}
+				continue
 			}
-			if con.Image == "" {
-				return fmt.Errorf("Image can't be empty")
-			} else {
-				matched, err := regexp.MatchString(`[^\s]*/[-a-z0-9_]+/[-a-z0-9_]+:[.a-z0-9-_]+`, con.Image)
-				if err != nil {
-					return fmt.Errorf("Regexp application.component.container.image failed, ErrorInfo is %s", err)
-				}
-				if !matched {
-					return fmt.Errorf(`application.component.container.image %s is invalid  regex used for validation is '[^\s]*/[-a-z0-9_]+/[-a-z0-9_]+:[.a-z0-9-_]+'`, con.Name)
-				}
+		}
+		if isTaskWorkload(com.WorkloadType) {
+			if value != "OnFailure" && value != "Never" {
+				allErrs = append(allErrs, field.NotSupported(valuePath, value, []string{"OnFailure", "Never"}))
 			}
-			if len(con.Ports) != 0 {
-				for _, port := range con.Ports {
-					if port.ContainerPort <= 0 {
-						return fmt.Errorf("Please input correct ContainerPort.")
-					}
-				}
+		} else if value != "Always" {
+			allErrs = append(allErrs, field.NotSupported(valuePath, value, []string{"Always"}))
+		}
+	}
+
+	traitsPath := fldPath.Child("componentTraits")
+	traits := com.ComponentTraits
+	if isSingletonWorkload(com.WorkloadType) {
+		if traits.Replicas != 1 {
+			allErrs = append(allErrs, field.Invalid(traitsPath.Child("replicas"), traits.Replicas, fmt.Sprintf("must be 1 for %s workloads", com.WorkloadType)))
+		}
+		if traits.Autoscaling != nil {
+			allErrs = append(allErrs, field.Forbidden(traitsPath.Child("autoscaling"), fmt.Sprintf("%s workloads cannot be autoscaled", com.WorkloadType)))
+		}
+	} else if traits.Replicas <= 0 {
+		allErrs = append(allErrs, field.Invalid(traitsPath.Child("replicas"), traits.Replicas, "must be at least 1"))
+	}
+	if traits.CustomMetric != nil && traits.CustomMetric.Enable && traits.CustomMetric.Uri == "" {
+		allErrs = append(allErrs, field.Required(traitsPath.Child("custommetric", "uri"), "required when custommetric is enabled"))
+	}
+	if traits.Autoscaling != nil && !isSingletonWorkload(com.WorkloadType) {
+		autoscalingPath := traitsPath.Child("autoscaling")
+		if traits.Autoscaling.Metric == "" {
+			allErrs = append(allErrs, field.Required(autoscalingPath.Child("metric"), ""))
+		}
+		if traits.Autoscaling.Threshold <= 0 {
+			allErrs = append(allErrs, field.Invalid(autoscalingPath.Child("threshold"), traits.Autoscaling.Threshold, "must be greater than 0"))
+		}
+		if traits.Autoscaling.MinReplicas <= 0 {
+			allErrs = append(allErrs, field.Invalid(autoscalingPath.Child("minreplicas"), traits.Autoscaling.MinReplicas, "must be greater than 0"))
+		}
+		if traits.Autoscaling.MaxReplicas <= traits.Autoscaling.MinReplicas {
+			allErrs = append(allErrs, field.Invalid(autoscalingPath.Child("maxreplicas"), traits.Autoscaling.MaxReplicas, "must be greater than minreplicas"))
+		}
+	}
+	return allErrs
+}
+
+func validateContainer(con *ComponentContainer, params map[string]string, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	allErrs = append(allErrs, validateDNS1035Label(con.Name, fldPath.Child("name"))...)
+
+	for i, env := range con.Env {
+		envPath := fldPath.Child("env").Index(i)
+		if env.Name == "" {
+			allErrs = append(allErrs, field.Required(envPath.Child("name"), ""))
+		}
+		if env.Value == "" && env.FromParam == "" {
+			allErrs = append(allErrs, field.Required(envPath.Child("value"), "one of value or fromParam must be set"))
+		}
+		if env.Value != "" && env.FromParam != "" && !isSubstituted(params, env.FromParam, env.Value) {
+			allErrs = append(allErrs, field.Forbidden(envPath.Child("fromParam"), "value and fromParam cannot be configured at the same time"))
+		}
+	}
+
+	for i, v := range con.Config {
+		configPath := fldPath.Child("config").Index(i)
+		if v.Path == "" {
+			allErrs = append(allErrs, field.Required(configPath.Child("path"), ""))
+		} else if !configPathRegexp.MatchString(v.Path) {
+			allErrs = append(allErrs, field.Invalid(configPath.Child("path"), v.Path, "must be an absolute path"))
+		}
+		if v.FileName == "" {
+			allErrs = append(allErrs, field.Required(configPath.Child("fileName"), ""))
+		}
+		if v.Value == "" && v.FromParam == "" {
+			allErrs = append(allErrs, field.Required(configPath.Child("value"), "one of value or fromParam must be set"))
+		}
+		if v.Value != "" && v.FromParam != "" && !isSubstituted(params, v.FromParam, v.Value) {
+			allErrs = append(allErrs, field.Forbidden(configPath.Child("fromParam"), "value and fromParam cannot be configured at the same time"))
+		}
+	}
+
+	allErrs = append(allErrs, validateImage(con.Name, con.Image, fldPath.Child("image"))...)
+
+	for i, port := range con.Ports {
+		if port.ContainerPort <= 0 {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("ports").Index(i).Child("containerPort"), port.ContainerPort, "must be greater than 0"))
+		}
+	}
+
+	if !(reflect.DeepEqual(con.Resources, CResource{})) {
+		resourcesPath := fldPath.Child("resources")
+		allErrs = append(allErrs, validateQuantity(con.Resources.Memory, resourcesPath.Child("memory"))...)
+		allErrs = append(allErrs, validateQuantity(con.Resources.Cpu, resourcesPath.Child("cpu"))...)
+		/*if con.Resources.Gpu <= 0 {
+			return fmt.Errorf("Regexp application.components.containers.resources.gpu must be greater than 0")
+		}*/
+		for i, v := range con.Resources.Volumes {
+			if reflect.DeepEqual(v, CVolume{}) {
+				continue
 			}
-			if !(reflect.DeepEqual(con.Resources, CResource{})) {
-				matched1, err1 := regexp.MatchString(`^[0-9]\d*[MG]i$`, con.Resources.Memory)
-				if err1 != nil {
-					return fmt.Errorf("Regexp application.components.containers.resources.memory failed, ErrorInfo is %s", err1)
-				}
-				if !matched1 {
-					return fmt.Errorf("application.components.containers.resources.memory's unit is err")
-				}
-				matched2, err2 := regexp.MatchString(`^[0-9]\d*m$`, con.Resources.Cpu)
-				if err2 != nil {
-					return fmt.Errorf("Regexp application.components.containers.resources.cpu failed, ErrorInfo is %s", err2)
-				}
-				if !matched2 {
-					return fmt.Errorf("application.components.containers.resources.cpu's unit is err")
-				}
-				/*if con.Resources.Gpu <= 0 {
-					return fmt.Errorf("Regexp application.components.containers.resources.gpu must be greater than 0")
-				}*/
-				if len(con.Resources.Volumes) != 0 {
-					for _, v := range con.Resources.Volumes {
-						if reflect.DeepEqual(v, CVolume{}) {
-							continue
-						}
-						if v.Name == "" || v.MountPath == "" {
-							return fmt.Errorf("application.components.container.resource.volumes's name and mountpath can't be empty at the same time")
-						}
-						if !v.Disk.Ephemeral && v.Disk.Required == "" {
-							return fmt.Errorf("if disk.ephemeral false,disk.required can't be empty")
-						}
-					}
-				}
+			volumePath := resourcesPath.Child("volumes").Index(i)
+			if v.Name == "" {
+				allErrs = append(allErrs, field.Required(volumePath.Child("name"), ""))
 			}
-			//if !reflect.DeepEqual(con.LivenessProbe, HealthProbe{}) {
-			if con.LivenessProbe != nil {
-				if con.LivenessProbe.Exec != nil {
-					if len(con.LivenessProbe.Exec.Command) == 0 {
-						return fmt.Errorf("If Exec option has configured,command can't be null")
-					}
-					if con.LivenessProbe.HTTPGet != nil {
-						return fmt.Errorf("Exec has been configured in livenessProbe,The other options cannot be selected")
-					}
-					if con.LivenessProbe.TCPSocket != nil {
-						return fmt.Errorf("Exec has been configured in livenessProbe,The other options cannot be selected")
-					}
-				} else {
-					if con.LivenessProbe.HTTPGet != nil {
-						if con.LivenessProbe.HTTPGet.Port <= 0 || con.LivenessProbe.HTTPGet.Path == "" {
-							return fmt.Errorf("Please check application.components.containers.livenessProbe's httpget field")
-						}
-						if con.LivenessProbe.TCPSocket != nil {
-							return fmt.Errorf("HttpGet has been configured in livenessProbe,The other options cannot be selected")
-						}
-					} else {
-						if con.LivenessProbe.TCPSocket != nil {
-							if con.LivenessProbe.TCPSocket.Port <= 0 {
-								return fmt.Errorf("Please check application.components.containers.livenessProbe's Tcpsocket field")
-							}
-						} else {
-							return fmt.Errorf("LivenessProbe's exec httpget tcpsocket are not configured,please unset livenessprobe field.")
-						}
-					}
-				}
-				if con.LivenessProbe.InitialDelaySeconds <= 0 || con.LivenessProbe.PeriodSeconds <= 0 || con.LivenessProbe.SuccessThreshold <= 0 || con.LivenessProbe.FailureThreshold <= 0 {
-					return fmt.Errorf("LivenessProbe's InitialDelaySeconds PeriodSeconds SuccessThreshold FailureThreshold can't <= 0")
-				}
+			if v.MountPath == "" {
+				allErrs = append(allErrs, field.Required(volumePath.Child("mountPath"), ""))
 			}
-			//if !reflect.DeepEqual(con.ReadinessProbe, HealthProbe{}) {
-			if con.ReadinessProbe != nil {
-				if con.ReadinessProbe.Exec != nil {
-					if len(con.ReadinessProbe.Exec.Command) == 0 {
-						return fmt.Errorf("If Exec option has configured,command can't be null")
-					}
-					if con.ReadinessProbe.HTTPGet != nil {
-						return fmt.Errorf("Exec has been configured in ReadinessProbe,The other options cannot be selected")
-					}
-					if con.ReadinessProbe.TCPSocket != nil {
-						return fmt.Errorf("Exec has been configured in ReadinessProbe,The other options cannot be selected")
-					}
-				} else {
-					if con.ReadinessProbe.HTTPGet != nil {
-						if con.ReadinessProbe.HTTPGet.Port <= 0 || con.ReadinessProbe.HTTPGet.Path == "" {
-							return fmt.Errorf("Please check application.components.containers.ReadinessProbe's httpget field")
-						}
-						if con.ReadinessProbe.TCPSocket != nil {
-							return fmt.Errorf("HttpGet has been configured in ReadinessProbe,The other options cannot be selected")
-						}
-					} else {
-						if con.ReadinessProbe.TCPSocket != nil {
-							if con.ReadinessProbe.TCPSocket.Port <= 0 {
-								return fmt.Errorf("Please check application.components.containers.ReadinessProbe's Tcpsocket field")
-							}
-						} else {
-							return fmt.Errorf("ReadinessProbe's exec httpget tcpsocket are not configured,please unset ReadinessProbe field.")
-						}
-					}
-				}
-				if con.ReadinessProbe.InitialDelaySeconds <= 0 || con.ReadinessProbe.PeriodSeconds <= 0 || con.ReadinessProbe.SuccessThreshold <= 0 || con.ReadinessProbe.FailureThreshold <= 0 {
-					return fmt.Errorf("ReadinessProbe's InitialDelaySeconds PeriodSeconds SuccessThreshold FailureThreshold can't <= 0")
-				}
+			if !v.Disk.Ephemeral && v.Disk.Required == "" {
+				allErrs = append(allErrs, field.Required(volumePath.Child("disk", "required"), "required when disk.ephemeral is false"))
 			}
 		}
-		if com.ComponentTraits.Replicas <= 0 {
-			return fmt.Errorf("app.spec.component.componenttraits.replicas at least 1")
+	}
+
+	if con.LivenessProbe != nil {
+		allErrs = append(allErrs, validateProbe(con.LivenessProbe, fldPath.Child("livenessProbe"))...)
+	}
+	if con.ReadinessProbe != nil {
+		allErrs = append(allErrs, validateProbe(con.ReadinessProbe, fldPath.Child("readinessProbe"))...)
+	}
+	return allErrs
+}
+
+func validateProbe(probe *HealthProbe, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	handlers := 0
+	if probe.Exec != nil {
+		handlers++
+		if len(probe.Exec.Command) == 0 {
+			allErrs = append(allErrs, field.Required(fldPath.Child("exec", "command"), ""))
 		}
-		if com.ComponentTraits.CustomMetric != nil {
-			if com.ComponentTraits.CustomMetric.Enable {
-				if com.ComponentTraits.CustomMetric.Uri == "" {
-					return fmt.Errorf("If com.ComponentTraits.CustomMetric.Enable is true,com.ComponentTraits.CustomMetric.Enable.uri can't be empty")
-				}
-			}
+	}
+	if probe.HTTPGet != nil {
+		handlers++
+		if probe.HTTPGet.Port <= 0 {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("httpGet", "port"), probe.HTTPGet.Port, "must be greater than 0"))
 		}
-		//if !reflect.DeepEqual(com.ComponentTraits.Autoscaling, Autoscaling{}) {
-		if com.ComponentTraits.Autoscaling != nil {
-			if com.ComponentTraits.Autoscaling.Metric == "" || com.ComponentTraits.Autoscaling.Threshold <= 0 || com.ComponentTraits.Autoscaling.MinReplicas <= 0 || com.ComponentTraits.Autoscaling.MaxReplicas <= com.ComponentTraits.Autoscaling.MinReplicas {
-				return fmt.Errorf("Please check autoscaling configuration")
-			}
+		if probe.HTTPGet.Path == "" {
+			allErrs = append(allErrs, field.Required(fldPath.Child("httpGet", "path"), ""))
 		}
 	}
-	if (reflect.DeepEqual(app.Spec.OptTraits, ComponentTraitsForOpt{})) {
-		return fmt.Errorf("application.opttraits.ingress must be configured")
+	if probe.TCPSocket != nil {
+		handlers++
+		if probe.TCPSocket.Port <= 0 {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("tcpSocket", "port"), probe.TCPSocket.Port, "must be greater than 0"))
+		}
+	}
+	switch {
+	case handlers == 0:
+		allErrs = append(allErrs, field.Required(fldPath, "one of exec, httpGet or tcpSocket must be configured"))
+	case handlers > 1:
+		allErrs = append(allErrs, field.Forbidden(fldPath, "only one of exec, httpGet or tcpSocket may be configured"))
+	}
+
+	if probe.InitialDelaySeconds <= 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("initialDelaySeconds"), probe.InitialDelaySeconds, "must be greater than 0"))
+	}
+	if probe.PeriodSeconds <= 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("periodSeconds"), probe.PeriodSeconds, "must be greater than 0"))
+	}
+	if probe.SuccessThreshold <= 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("successThreshold"), probe.SuccessThreshold, "must be greater than 0"))
+	}
+	if probe.FailureThreshold <= 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("failureThreshold"), probe.FailureThreshold, "must be greater than 0"))
+	}
+	return allErrs
+}
+
+func validateOptTraits(opt *ComponentTraitsForOpt, workloadType WorkloadType, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	ingressPath := fldPath.Child("ingress")
+	if !isExposedWorkload(workloadType) {
+		if !reflect.DeepEqual(opt.Ingress, AppIngress{}) {
+			allErrs = append(allErrs, field.Forbidden(ingressPath, fmt.Sprintf("%s workloads cannot be exposed through an ingress", workloadType)))
+		}
+	} else if reflect.DeepEqual(opt.Ingress, AppIngress{}) {
+		allErrs = append(allErrs, field.Required(ingressPath, "ingress must be configured"))
 	} else {
-		if reflect.DeepEqual(app.Spec.OptTraits.Ingress, AppIngress{}) {
-			return fmt.Errorf("application.opttraits.ingress must be configured")
-		} else {
-			if app.Spec.OptTraits.Ingress.Host == "" || app.Spec.OptTraits.Ingress.Path == "" || app.Spec.OptTraits.Ingress.ServerPort <= 0 {
-				return fmt.Errorf("application.opttraits.ingress's host、path and serverPort can't be empty at the same time")
-			} else {
-				//matched, err := regexp.MatchString(`^\/(\w+\/?)+$`, app.Spec.OptTraits.Ingress.Path)
-				if app.Spec.OptTraits.Ingress.Path != "/" {
-					//return fmt.Errorf("Regexp application.opttraits.ingress's failed, ErrorInfo is %s", err)
-					return fmt.Errorf("application.opttraits.ingress's path must be /")
-				}
-			}
+		if opt.Ingress.Host == "" {
+			allErrs = append(allErrs, field.Required(ingressPath.Child("host"), ""))
 		}
-		//if !(reflect.DeepEqual(app.Spec.OptTraits.RateLimit, RateLimit{})) {
-		if app.Spec.OptTraits.RateLimit != nil {
-			if app.Spec.OptTraits.RateLimit.TimeDuration == "" || app.Spec.OptTraits.RateLimit.RequestAmount <= 0 {
-				return fmt.Errorf("application.opttraits.ratelimit.timeduration and requestamount can't be empty at the same time")
+		if opt.Ingress.Path == "" {
+			allErrs = append(allErrs, field.Required(ingressPath.Child("path"), ""))
+		}
+		if opt.Ingress.ServerPort <= 0 {
+			allErrs = append(allErrs, field.Invalid(ingressPath.Child("serverPort"), opt.Ingress.ServerPort, "must be greater than 0"))
+		}
+	}
+
+	if opt.RateLimit != nil {
+		rateLimitPath := fldPath.Child("rateLimit")
+		allErrs = append(allErrs, validateDuration(opt.RateLimit.TimeDuration, parseDayDuration, time.Second, 24*time.Hour, rateLimitPath.Child("timeDuration"))...)
+		if opt.RateLimit.RequestAmount <= 0 {
+			allErrs = append(allErrs, field.Invalid(rateLimitPath.Child("requestAmount"), opt.RateLimit.RequestAmount, "must be greater than 0"))
+		}
+		for i, o := range opt.RateLimit.Overrides {
+			overridePath := rateLimitPath.Child("overrides").Index(i)
+			if o.RequestAmount <= 0 {
+				allErrs = append(allErrs, field.Invalid(overridePath.Child("requestAmount"), o.RequestAmount, "must be greater than 0"))
 			}
-			matched, err := checkinterval(app.Spec.OptTraits.RateLimit.TimeDuration)
-			if !matched {
-				if err != nil {
-					return fmt.Errorf("application.opttraits.ratelimit.timeduration regex failed errinfo is %v", err)
-				}
-				return fmt.Errorf("application.opttraits.ratelimit.timeduration must end with s or m")
+			if o.User == "" {
+				allErrs = append(allErrs, field.Required(overridePath.Child("user"), ""))
 			}
-			if len(app.Spec.OptTraits.RateLimit.Overrides) != 0 {
-				for _, i := range app.Spec.OptTraits.RateLimit.Overrides {
-					if i.RequestAmount <= 0 || i.User == "" {
-						return fmt.Errorf("application.opttraits.ratelimit.overrides.user and requestamount can't be empty at the same time")
-					}
-				}
+		}
+	}
+
+	if opt.WhiteList != nil {
+		for i, user := range opt.WhiteList.Users {
+			if !userRegexp.MatchString(user) {
+				allErrs = append(allErrs, field.Invalid(fldPath.Child("whiteList", "users").Index(i), user, "must be an email address"))
 			}
 		}
-		if app.Spec.OptTraits.WhiteList != nil {
-			if len(app.Spec.OptTraits.WhiteList.Users) != 0 {
-				for _, i := range app.Spec.OptTraits.WhiteList.Users {
-					matched, err := regexp.MatchString(`^.*@.*$`, i)
-					if err != nil {
-						return fmt.Errorf("Regexp application.opttraits.whitelist.users %s failed, ErrorInfo is %s", i, err)
-					}
-					if matched {
-						continue
-					} else {
-						return fmt.Errorf("Regexp application.opttraits.whitelist.users %s failed", i)
-					}
-				}
+	}
+
+	if opt.HTTPRetry != nil {
+		retryPath := fldPath.Child("httpretry")
+		if opt.HTTPRetry.Attempts <= 0 {
+			allErrs = append(allErrs, field.Invalid(retryPath.Child("attempts"), opt.HTTPRetry.Attempts, "must be greater than 0"))
+		}
+		allErrs = append(allErrs, validateDuration(opt.HTTPRetry.PerTryTimeout, parseDuration, time.Millisecond, time.Hour, retryPath.Child("perTryTimeout"))...)
+	}
+
+	if opt.LoadBalancer != nil {
+		allErrs = append(allErrs, validateLoadBalancer(opt.LoadBalancer, fldPath.Child("loadBalancer"))...)
+	}
+
+	if opt.CircuitBreaking != nil {
+		cbPath := fldPath.Child("circuitbreaking")
+		if opt.CircuitBreaking.ConnectionPool != nil {
+			allErrs = append(allErrs, validateConnectionPool(opt.CircuitBreaking.ConnectionPool, cbPath.Child("connectionPool"))...)
+		}
+		if opt.CircuitBreaking.OutlierDetection != nil {
+			allErrs = append(allErrs, validateOutlierDetection(opt.CircuitBreaking.OutlierDetection, cbPath.Child("outlierDetection"))...)
+		}
+	}
+	return allErrs
+}
+
+// maxConnectionPoolLimit bounds the HTTP connection pool settings.
+const maxConnectionPoolLimit = 1000000
+
+func validateConnectionPool(pool *ConnectionPoolSettings, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if pool.TCP != nil {
+		tcpPath := fldPath.Child("tcp")
+		if pool.TCP.MaxConnections <= 0 {
+			allErrs = append(allErrs, field.Invalid(tcpPath.Child("maxConnections"), pool.TCP.MaxConnections, "must be greater than 0"))
+		}
+		allErrs = append(allErrs, validateDuration(pool.TCP.ConnectTimeout, parseDuration, time.Millisecond, time.Hour, tcpPath.Child("connectTimeout"))...)
+	}
+	if pool.HTTP != nil {
+		httpPath := fldPath.Child("http")
+		for _, limit := range []struct {
+			name  string
+			value int32
+		}{
+			{"http1MaxPendingRequests", pool.HTTP.HTTP1MaxPendingRequests},
+			{"http2MaxRequests", pool.HTTP.HTTP2MaxRequests},
+			{"maxRequestsPerConnection", pool.HTTP.MaxRequestsPerConnection},
+			{"maxRetries", pool.HTTP.MaxRetries},
+		} {
+			if limit.value < 0 || limit.value > maxConnectionPoolLimit {
+				allErrs = append(allErrs, field.Invalid(httpPath.Child(limit.name), limit.value, fmt.Sprintf("must be between 0 and %d", maxConnectionPoolLimit)))
 			}
 		}
-		if app.Spec.OptTraits.HTTPRetry != nil {
-			if app.Spec.OptTraits.HTTPRetry.Attempts <= 0 || app.Spec.OptTraits.HTTPRetry.PerTryTimeout == "" {
-				return fmt.Errorf("Please check httpretry configuration")
+	}
+	return allErrs
+}
+
+func validateOutlierDetection(od *OutlierDetection, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if od.ConsecutiveErrors <= 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("consecutiveErrors"), od.ConsecutiveErrors, "must be greater than 0"))
+	}
+	if od.MaxEjectionPercent <= 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("maxEjectionPercent"), od.MaxEjectionPercent, "must be greater than 0"))
+	}
+	allErrs = append(allErrs, validateDuration(od.BaseEjectionTime, parseDuration, time.Millisecond, time.Hour, fldPath.Child("baseEjectionTime"))...)
+	allErrs = append(allErrs, validateDuration(od.Interval, parseDuration, time.Millisecond, time.Hour, fldPath.Child("interval"))...)
+	return allErrs
+}
+
+// validatePortLevelSettings checks that every entry selects a distinct
+// container port of the application, by number or by name, and validates its
+// traffic policy like the top level one.
+func validatePortLevelSettings(settings []PortTrafficPolicy, ports []AppPort, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	numbers := map[int32]bool{}
+	names := map[string]int32{}
+	for _, port := range ports {
+		numbers[port.ContainerPort] = true
+		if port.Name != "" {
+			names[port.Name] = port.ContainerPort
+		}
+	}
+
+	selected := map[int32]bool{}
+	for i := range settings {
+		setting := &settings[i]
+		portPath := fldPath.Index(i).Child("port")
+		var number int32
+		switch sel := setting.Port; {
+		case sel.Number == 0 && sel.Name == "":
+			allErrs = append(allErrs, field.Required(portPath, "one of number or name must be set"))
+		case sel.Number != 0 && sel.Name != "":
+			allErrs = append(allErrs, field.Forbidden(portPath.Child("name"), "number and name cannot be configured at the same time"))
+		case sel.Number != 0:
+			if sel.Number > 65535 || !numbers[int32(sel.Number)] {
+				allErrs = append(allErrs, field.NotFound(portPath.Child("number"), sel.Number))
+			} else {
+				number = int32(sel.Number)
 			}
-			matched, err := checkinterval(app.Spec.OptTraits.HTTPRetry.PerTryTimeout)
-			if !matched {
-				if err != nil {
-					return fmt.Errorf("application.opttraits.httpretry.pertrytimeout regex failed errinfo is %v", err)
-				}
-				return fmt.Errorf("application.opttraits.httpretry.pertrytimeout must end with s or m")
+		default:
+			if n, ok := names[sel.Name]; !ok {
+				allErrs = append(allErrs, field.NotFound(portPath.Child("name"), sel.Name))
+			} else {
+				number = n
 			}
 		}
-		//if !(reflect.DeepEqual(app.Spec.OptTraits.CircuitBreaking, CircuitBreaking{})) {
-		if app.Spec.OptTraits.CircuitBreaking != nil {
-			//if !reflect.DeepEqual(app.Spec.OptTraits.CircuitBreaking.ConnectionPool, ConnectionPoolSettings{}) {
-			if app.Spec.OptTraits.CircuitBreaking.ConnectionPool != nil {
-				//if !reflect.DeepEqual(app.Spec.OptTraits.CircuitBreaking.ConnectionPool.TCP, TCPSettings{}) {
-				if app.Spec.OptTraits.CircuitBreaking.ConnectionPool.TCP != nil {
-					if app.Spec.OptTraits.CircuitBreaking.ConnectionPool.TCP.MaxConnections <= 0 {
-						return fmt.Errorf("app.Spec.OptTraits.CircuitBreaking.ConnectionPool.TCP.MaxConnections must >=0")
-					}
-					match, err := checkinterval(app.Spec.OptTraits.CircuitBreaking.ConnectionPool.TCP.ConnectTimeout)
-					if !match {
-						if err != nil {
-							return fmt.Errorf("app.Spec.OptTraits.CircuitBreaking.ConnectionPool.TCP.ConnectTimeout regex failed errinfo is %v", err)
-						}
-						return fmt.Errorf("app.Spec.OptTraits.CircuitBreaking.ConnectionPool.TCP.ConnectTimeout must end with s or m")
-					}
-				}
-			}
-			//if !reflect.DeepEqual(app.Spec.OptTraits.CircuitBreaking.OutlierDetection, OutlierDetection{}) {
-			if app.Spec.OptTraits.CircuitBreaking.OutlierDetection != nil {
-				if app.Spec.OptTraits.CircuitBreaking.OutlierDetection.BaseEjectionTime == "" || app.Spec.OptTraits.CircuitBreaking.OutlierDetection.Interval == "" || app.Spec.OptTraits.CircuitBreaking.OutlierDetection.ConsecutiveErrors <= 0 || app.Spec.OptTraits.CircuitBreaking.OutlierDetection.MaxEjectionPercent <= 0 {
-					return fmt.Errorf("Please check httpretry configuration")
-				}
-				match, err := checkinterval(app.Spec.OptTraits.CircuitBreaking.OutlierDetection.BaseEjectionTime)
-				if !match {
-					if err != nil {
-						return fmt.Errorf("app.Spec.OptTraits.CircuitBreaking.OutlierDetection.BaseEjectionTime regex failed errinfo is %v", err)
-					}
-					return fmt.Errorf("app.Spec.OptTraits.CircuitBreaking.OutlierDetection.BaseEjectionTime must end with s or m")
-				}
-				match, err = checkinterval(app.Spec.OptTraits.CircuitBreaking.OutlierDetection.Interval)
-				if !match {
-					if err != nil {
-						return fmt.Errorf("app.Spec.OptTraits.CircuitBreaking.OutlierDetection.Interval regex failed errinfo is %v", err)
-					}
-					return fmt.Errorf("app.Spec.OptTraits.CircuitBreaking.OutlierDetection.Interval must end with s or m")
-				}
+		if number != 0 {
+			if selected[number] {
+				allErrs = append(allErrs, field.Duplicate(portPath, number))
 			}
+			selected[number] = true
+		}
+
+		allErrs = append(allErrs, validateLoadBalancer(&setting.LoadBalancer, fldPath.Index(i).Child("loadBalancer"))...)
+		if !reflect.DeepEqual(setting.ConnectionPool, ConnectionPoolSettings{}) {
+			allErrs = append(allErrs, validateConnectionPool(&setting.ConnectionPool, fldPath.Index(i).Child("connectionPool"))...)
+		}
+		if !reflect.DeepEqual(setting.OutlierDetection, OutlierDetection{}) {
+			allErrs = append(allErrs, validateOutlierDetection(&setting.OutlierDetection, fldPath.Index(i).Child("outlierDetection"))...)
 		}
 	}
-	return nil
+	return allErrs
 }
 
-func checkinterval(interval string) (match bool, err error) {
-	matched, err := regexp.MatchString(`^[0-9]\d*[s|m|d]$`, interval)
+// maxRingSize is the largest minimum ring size Envoy accepts for the ring
+// hash load balancer.
+const maxRingSize = 8 * 1024 * 1024
+
+// validateLoadBalancer checks that lb sets either a simple algorithm or a
+// consistent hash, and that the consistent hash has exactly one key.
+func validateLoadBalancer(lb *LoadBalancerSettings, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	switch lb.Simple {
+	case "", SimpleLBRoundRobin, SimpleLBLeastConn, SimpleLBRandom, SimpleLBPassthrough:
+	default:
+		allErrs = append(allErrs, field.NotSupported(fldPath.Child("simple"), lb.Simple,
+			[]string{string(SimpleLBRoundRobin), string(SimpleLBLeastConn), string(SimpleLBRandom), string(SimpleLBPassthrough)}))
+	}
+	if lb.ConsistentHash == nil {
+		return allErrs
+	}
+	chPath := fldPath.Child("consistentHash")
+	if lb.Simple != "" {
+		allErrs = append(allErrs, field.Forbidden(chPath, "simple and consistentHash cannot be configured at the same time"))
+	}
+	ch := lb.ConsistentHash
+	switch {
+	case ch.HTTPHeaderName == "" && !ch.UseSourceIP:
+		allErrs = append(allErrs, field.Required(chPath, "one of httpHeaderName or useSourceIp must be set"))
+	case ch.HTTPHeaderName != "" && ch.UseSourceIP:
+		allErrs = append(allErrs, field.Forbidden(chPath.Child("useSourceIp"), "httpHeaderName and useSourceIp cannot be configured at the same time"))
+	case ch.HTTPHeaderName != "" && !httpguts.ValidHeaderFieldName(ch.HTTPHeaderName):
+		allErrs = append(allErrs, field.Invalid(chPath.Child("httpHeaderName"), ch.HTTPHeaderName, "must be a valid HTTP header name"))
+	}
+	if ch.MinimumRingSize > maxRingSize {
+		allErrs = append(allErrs, field.Invalid(chPath.Child("minimumRingSize"), ch.MinimumRingSize, fmt.Sprintf("must be at most %d", maxRingSize)))
+	}
+	return allErrs
+}
+
+// validateGrayRelease checks that the traffic weights refer to the component
+// versions, are percentages that sum to 100, and leave out at most one
+// version.
+func validateGrayRelease(grayRelease map[string]int, versions []string, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if len(grayRelease) == 0 {
+		return allErrs
+	}
+	keys := make([]string, 0, len(grayRelease))
+	for version := range grayRelease {
+		keys = append(keys, version)
+	}
+	sort.Strings(keys)
+
+	sum := 0
+	for _, version := range keys {
+		weight := grayRelease[version]
+		if !containsString(versions, version) {
+			allErrs = append(allErrs, field.NotFound(fldPath.Key(version), version))
+		}
+		if weight < 0 || weight > 100 {
+			allErrs = append(allErrs, field.Invalid(fldPath.Key(version), weight, "must be between 0 and 100"))
+		}
+		sum += weight
+	}
+	if sum != 100 {
+		allErrs = append(allErrs, field.Invalid(fldPath, sum, "weights must sum to 100"))
+	}
+	var missing []string
+	for _, version := range versions {
+		if _, ok := grayRelease[version]; !ok {
+			missing = append(missing, version)
+		}
+	}
+	if len(missing) > 1 {
+		allErrs = append(allErrs, field.Invalid(fldPath, strings.Join(missing, ", "), "at most one version may be left out"))
+	}
+	return allErrs
+}
+
+// validateQuantity checks that value, if set, is a positive Kubernetes
+// quantity such as 500m, 0.5, 512Mi or 1Ti.
+func validateQuantity(value string, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if value == "" {
+		return allErrs
+	}
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		return append(allErrs, field.Invalid(fldPath, value, err.Error()))
+	}
+	if q.Sign() <= 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath, value, "must be greater than 0"))
+	}
+	return allErrs
+}
+
+// validateImage checks that image is a valid reference as defined by the
+// distribution spec: an optional registry host and port, a repository path
+// of one or more components, and an optional tag and digest.
+func validateImage(container, image string, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if image == "" {
+		return append(allErrs, field.Required(fldPath, fmt.Sprintf("container %q must specify an image", container)))
+	}
+	if _, err := reference.ParseNormalizedNamed(image); err != nil {
+		allErrs = append(allErrs, field.Invalid(fldPath, image, fmt.Sprintf("container %q has an invalid image reference: %v", container, err)))
+	}
+	return allErrs
+}
+
+func validateDNS1035Label(name string, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if name == "" {
+		return append(allErrs, field.Required(fldPath, ""))
+	}
+	if msgs := validation.IsDNS1035Label(name); len(msgs) != 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath, name, strings.Join(msgs, "; ")))
+	}
+	return allErrs
+}
+
+// validateDuration checks that value is a duration parsed by parse between
+// min and max.
+func validateDuration(value string, parse func(string) (time.Duration, error), min, max time.Duration, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if value == "" {
+		return append(allErrs, field.Required(fldPath, ""))
+	}
+	d, err := parse(value)
+	switch {
+	case err != nil:
+		allErrs = append(allErrs, field.Invalid(fldPath, value, err.Error()))
+	case d < min || d > max:
+		allErrs = append(allErrs, field.Invalid(fldPath, value, fmt.Sprintf("must be between %v and %v", min, max)))
+	}
+	return allErrs
+}
+
+// parseDayDuration parses a whole number of days such as 1d, which rate
+// limits accept, or else a duration like parseDuration.
+func parseDayDuration(value string) (time.Duration, error) {
+	days := strings.TrimSuffix(value, "d")
+	if days == value {
+		return parseDuration(value)
+	}
+	n, err := strconv.ParseUint(days, 10, 16)
 	if err != nil {
-		return false, fmt.Errorf("Regexp failed, ErrorInfo is %s", err)
+		return 0, fmt.Errorf("invalid duration %q", value)
 	}
-	if !matched {
-		return false, nil
+	return time.Duration(n) * 24 * time.Hour, nil
+}
+
+// parseDuration parses durations the way Istio accepts them, such as 500ms,
+// 1.5s or 1h30m, with millisecond precision.
+func parseDuration(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q, use units such as ms, s, m or h", value)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("duration %q must not be negative", value)
+	}
+	if d%time.Millisecond != 0 {
+		return 0, fmt.Errorf("duration %q must be a whole number of milliseconds", value)
+	}
+	return d, nil
+}
+
+// isExposedWorkload reports whether workloads of type t serve traffic. An
+// unknown type is treated as a server so that the ingress is still checked.
+func isExposedWorkload(t WorkloadType) bool {
+	switch t {
+	case Worker, SingletonWorker, Task, SingletonTask:
+		return false
+	}
+	return true
+}
+
+func isSingletonWorkload(t WorkloadType) bool {
+	return t == SingletonServer || t == SingletonWorker || t == SingletonTask
+}
+
+func isTaskWorkload(t WorkloadType) bool {
+	return t == Task || t == SingletonTask
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
 	}
-	return true, nil
+	return false
 }
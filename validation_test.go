@@ -0,0 +1,366 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// validApplication returns an Application that passes every built-in check.
+func validApplication() *Application {
+	return &Application{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"},
+		Spec: ApplicationSpec{
+			Components: []Component{{
+				Name:         "web",
+				Version:      "v1",
+				WorkloadType: Server,
+				Containers: []ComponentContainer{{
+					Name:  "nginx",
+					Image: "socp.io/library/nginx:1.19",
+					Ports: []AppPort{{Name: "http", ContainerPort: 80}},
+				}},
+				ComponentTraits: ComponentTraits{Replicas: 1},
+			}},
+			OptTraits: ComponentTraitsForOpt{
+				Ingress: AppIngress{Host: "demo.example.com", Path: "/", ServerPort: 80},
+			},
+		},
+	}
+}
+
+func TestValidateDNS1035Label(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"web":                   true,
+		"web-v2":                true,
+		"web_v2":                false,
+		"web-":                  false,
+		"Web":                   false,
+		"2web":                  false,
+		strings.Repeat("a", 64): false,
+	} {
+		if errs := validateDNS1035Label(name, field.NewPath("metadata", "name")); (len(errs) == 0) != valid {
+			t.Errorf("%s: expected valid=%v, got %v", name, valid, errs)
+		}
+	}
+}
+
+func TestValidationAggregatesErrors(t *testing.T) {
+	if errs := validApplication().Validation(); len(errs) != 0 {
+		t.Fatalf("expected valid application, got %v", errs)
+	}
+
+	app := validApplication()
+	app.Spec.Components = append(app.Spec.Components, app.Spec.Components[0])
+	app.Spec.Components[1].Containers = []ComponentContainer{{Name: "nginx"}}
+	app.Spec.Components[1].ComponentTraits.Replicas = 0
+	app.Spec.OptTraits.Ingress.Path = ""
+
+	want := map[string]bool{
+		"spec.components[1].version":                  false,
+		"spec.components[1].containers[0].image":      false,
+		"spec.components[1].componentTraits.replicas": false,
+		"spec.optTraits.ingress.path":                 false,
+	}
+	errs := app.Validation()
+	for _, err := range errs {
+		if _, ok := want[err.Field]; !ok {
+			t.Errorf("unexpected error %v", err)
+		}
+		want[err.Field] = true
+	}
+	for path, found := range want {
+		if !found {
+			t.Errorf("missing error for %s in %v", path, errs)
+		}
+	}
+}
+
+func TestValidationUpdate(t *testing.T) {
+	old := validApplication()
+	if errs := validApplication().ValidationUpdate(old); len(errs) != 0 {
+		t.Fatalf("expected unchanged application to be valid, got %v", errs)
+	}
+
+	app := validApplication()
+	app.Spec.Components = append(app.Spec.Components, app.Spec.Components[0])
+	app.Spec.Components[1].Version = "v2"
+	app.Spec.Components[1].Containers = []ComponentContainer{{Name: "nginx", Image: "socp.io/library/nginx:1.21"}}
+	app.Spec.OptTraits.Ingress.Host = "new.example.com"
+	app.Annotations = map[string]string{admissionWebhookAnnotationIngressHostKey: "new.example.com"}
+	if errs := app.ValidationUpdate(old); len(errs) != 0 {
+		t.Fatalf("expected new version and acknowledged host to be valid, got %v", errs)
+	}
+
+	app = validApplication()
+	app.Name = "renamed"
+	app.Spec.Components[0].Name = "api"
+	app.Spec.Components[0].Containers[0].Image = "socp.io/library/nginx:1.21"
+	app.Spec.OptTraits.Ingress.Host = "new.example.com"
+	app.Annotations = map[string]string{admissionWebhookAnnotationIngressHostKey: "other.example.com"}
+	want := []string{
+		"metadata.name",
+		"spec.components[0].name",
+		"spec.components[0].containers[0].image",
+		"spec.optTraits.ingress.host",
+	}
+	errs := app.ValidationUpdate(old)
+	if len(errs) != len(want) {
+		t.Fatalf("expected %d errors, got %v", len(want), errs)
+	}
+	for i, err := range errs {
+		if err.Field != want[i] {
+			t.Errorf("expected error for %s, got %v", want[i], err)
+		}
+	}
+
+	app = validApplication()
+	app.Spec.Components = nil
+	if errs := app.ValidationUpdate(old); len(errs) != 1 || errs[0].Field != "spec.components" {
+		t.Errorf("expected removing the last component to be rejected, got %v", errs)
+	}
+}
+
+func TestValidationWorkloadTypes(t *testing.T) {
+	for _, workloadType := range []WorkloadType{Server, SingletonServer, Worker, SingletonWorker, Task, SingletonTask} {
+		app := validApplication()
+		app.Spec.Components[0].WorkloadType = workloadType
+		if !isExposedWorkload(workloadType) {
+			app.Spec.Components[0].Containers[0].Ports = nil
+			app.Spec.OptTraits.Ingress = AppIngress{}
+		}
+		if errs := app.Validation(); len(errs) != 0 {
+			t.Errorf("%s: expected valid application, got %v", workloadType, errs)
+		}
+	}
+
+	app := validApplication()
+	app.Spec.Components[0].WorkloadType = SingletonTask
+	app.Spec.Components[0].ComponentTraits.Replicas = 2
+	app.Spec.Components[0].ComponentTraits.Autoscaling = &Autoscaling{Metric: "cpu", Threshold: 80, MinReplicas: 1, MaxReplicas: 3}
+	app.Spec.Components[0].Containers[0].ReadinessProbe = &HealthProbe{
+		Handler:             Handler{Exec: &ExecAction{Command: []string{"true"}}},
+		InitialDelaySeconds: 1, PeriodSeconds: 1, SuccessThreshold: 1, FailureThreshold: 1,
+	}
+	app.Spec.Components[0].WorkloadSettings = []WorkloadSetting{{Name: "restartPolicy", Value: "Always"}}
+	want := []string{
+		"spec.components[0].containers[0].ports",
+		"spec.components[0].containers[0].readinessProbe",
+		"spec.components[0].workloadSetings[0].value",
+		"spec.components[0].componentTraits.replicas",
+		"spec.components[0].componentTraits.autoscaling",
+		"spec.optTraits.ingress",
+	}
+	errs := app.Validation()
+	if len(errs) != len(want) {
+		t.Fatalf("expected %d errors, got %v", len(want), errs)
+	}
+	for i, err := range errs {
+		if err.Field != want[i] {
+			t.Errorf("expected error for %s, got %v", want[i], err)
+		}
+	}
+
+	app = validApplication()
+	app.Spec.Components = append(app.Spec.Components, app.Spec.Components[0])
+	app.Spec.Components[1].Version = "v2"
+	app.Spec.Components[1].WorkloadType = SingletonServer
+	if errs := app.Validation(); len(errs) != 1 || errs[0].Field != "spec.components[1].workloadType" {
+		t.Errorf("expected mixed workload types to be rejected, got %v", errs)
+	}
+}
+
+func TestValidateImage(t *testing.T) {
+	for _, image := range []string{
+		"nginx",
+		"nginx:1.19",
+		"library/nginx:1.19",
+		"registry:5000/a/b/c:tag",
+		"socp.io/zk/sidecar:0407",
+		"[::1]:5000/nginx:1.19",
+		"repo@sha256:" + strings.Repeat("a", 64),
+		"registry.example.com/team/app:v1@sha256:" + strings.Repeat("b", 64),
+	} {
+		if errs := validateImage("app", image, field.NewPath("image")); len(errs) != 0 {
+			t.Errorf("expected %s to be valid, got %v", image, errs)
+		}
+	}
+
+	for _, image := range []string{
+		"Nginx:1.19",
+		"nginx:",
+		"nginx:" + strings.Repeat("a", 129),
+		"repo@sha256:abc",
+		"registry:port/nginx",
+		"x/y:1.0 garbage socp.io/a/b:1",
+		strings.Repeat("a", 256),
+	} {
+		errs := validateImage("app", image, field.NewPath("image"))
+		if len(errs) != 1 || !strings.Contains(errs[0].Detail, `container "app"`) {
+			t.Errorf("expected %s to be rejected naming the container, got %v", image, errs)
+		}
+	}
+}
+
+func TestValidateQuantity(t *testing.T) {
+	for _, value := range []string{"", "1", "0.5", "500m", "512Ki", "1Ti"} {
+		if errs := validateQuantity(value, field.NewPath("cpu")); len(errs) != 0 {
+			t.Errorf("expected %q to be valid, got %v", value, errs)
+		}
+	}
+	for _, value := range []string{"1x", "Mi", "0", "-1"} {
+		if errs := validateQuantity(value, field.NewPath("cpu")); len(errs) != 1 {
+			t.Errorf("expected %q to be rejected, got %v", value, errs)
+		}
+	}
+}
+
+func TestValidateGrayRelease(t *testing.T) {
+	versions := []string{"v1", "v2", "v3"}
+	for _, grayRelease := range []map[string]int{
+		nil,
+		{"v1": 90, "v2": 10},
+		{"v1": 0, "v2": 50, "v3": 50},
+	} {
+		if errs := validateGrayRelease(grayRelease, versions, field.NewPath("grayRelease")); len(errs) != 0 {
+			t.Errorf("expected %v to be valid, got %v", grayRelease, errs)
+		}
+	}
+
+	for _, tc := range []struct {
+		grayRelease map[string]int
+		want        []string
+	}{
+		{map[string]int{"v1": 80, "v2": 10, "v4": 10}, []string{"grayRelease[v4]"}},
+		{map[string]int{"v1": 120, "v2": -20}, []string{"grayRelease[v1]", "grayRelease[v2]"}},
+		{map[string]int{"v1": 50, "v2": 40}, []string{"grayRelease"}},
+		{map[string]int{"v1": 100}, []string{"grayRelease"}},
+	} {
+		errs := validateGrayRelease(tc.grayRelease, versions, field.NewPath("grayRelease"))
+		if len(errs) != len(tc.want) {
+			t.Errorf("%v: expected %d errors, got %v", tc.grayRelease, len(tc.want), errs)
+			continue
+		}
+		for i, err := range errs {
+			if err.Field != tc.want[i] {
+				t.Errorf("%v: expected error for %s, got %v", tc.grayRelease, tc.want[i], err)
+			}
+		}
+	}
+}
+
+func TestValidateLoadBalancer(t *testing.T) {
+	for _, lb := range []LoadBalancerSettings{
+		{},
+		{Simple: SimpleLBLeastConn},
+		{ConsistentHash: &ConsistentHashLB{HTTPHeaderName: "x-user-id", MinimumRingSize: 1024}},
+		{ConsistentHash: &ConsistentHashLB{UseSourceIP: true}},
+	} {
+		if errs := validateLoadBalancer(&lb, field.NewPath("loadBalancer")); len(errs) != 0 {
+			t.Errorf("expected %+v to be valid, got %v", lb, errs)
+		}
+	}
+
+	for _, tc := range []struct {
+		lb   LoadBalancerSettings
+		want []string
+	}{
+		{LoadBalancerSettings{Simple: "rr"}, []string{"loadBalancer.simple"}},
+		{LoadBalancerSettings{Simple: SimpleLBRandom, ConsistentHash: &ConsistentHashLB{UseSourceIP: true}}, []string{"loadBalancer.consistentHash"}},
+		{LoadBalancerSettings{ConsistentHash: &ConsistentHashLB{}}, []string{"loadBalancer.consistentHash"}},
+		{LoadBalancerSettings{ConsistentHash: &ConsistentHashLB{HTTPHeaderName: "x-user", UseSourceIP: true}}, []string{"loadBalancer.consistentHash.useSourceIp"}},
+		{LoadBalancerSettings{ConsistentHash: &ConsistentHashLB{HTTPHeaderName: "x user"}}, []string{"loadBalancer.consistentHash.httpHeaderName"}},
+		{LoadBalancerSettings{ConsistentHash: &ConsistentHashLB{UseSourceIP: true, MinimumRingSize: maxRingSize + 1}}, []string{"loadBalancer.consistentHash.minimumRingSize"}},
+	} {
+		errs := validateLoadBalancer(&tc.lb, field.NewPath("loadBalancer"))
+		if len(errs) != len(tc.want) {
+			t.Errorf("%+v: expected %d errors, got %v", tc.lb, len(tc.want), errs)
+			continue
+		}
+		for i, err := range errs {
+			if err.Field != tc.want[i] {
+				t.Errorf("%+v: expected error for %s, got %v", tc.lb, tc.want[i], err)
+			}
+		}
+	}
+
+	app := validApplication()
+	app.Spec.OptTraits.CircuitBreaking = &CircuitBreaking{PortLevelSettings: []PortTrafficPolicy{{
+		Port:         PortSelector{Number: 80},
+		LoadBalancer: LoadBalancerSettings{Simple: "rr"},
+	}}}
+	errs := app.Validation()
+	if len(errs) != 1 || errs[0].Field != "spec.optTraits.circuitbreaking.portLevelSettings[0].loadBalancer.simple" {
+		t.Errorf("expected the port level load balancer to be validated, got %v", errs)
+	}
+}
+
+func TestValidatePortLevelSettings(t *testing.T) {
+	ports := []AppPort{{Name: "http", ContainerPort: 80}, {Name: "grpc", ContainerPort: 9090}}
+	valid := []PortTrafficPolicy{
+		{Port: PortSelector{Number: 80}, ConnectionPool: ConnectionPoolSettings{HTTP: &HTTPSettings{HTTP1MaxPendingRequests: 100}}},
+		{Port: PortSelector{Name: "grpc"}, OutlierDetection: OutlierDetection{ConsecutiveErrors: 5, MaxEjectionPercent: 50, Interval: "10s", BaseEjectionTime: "30s"}},
+	}
+	if errs := validatePortLevelSettings(valid, ports, field.NewPath("portLevelSettings")); len(errs) != 0 {
+		t.Fatalf("expected valid port level settings, got %v", errs)
+	}
+
+	invalid := []PortTrafficPolicy{
+		{Port: PortSelector{}},
+		{Port: PortSelector{Number: 80, Name: "http"}},
+		{Port: PortSelector{Number: 8080}},
+		{Port: PortSelector{Name: "metrics"}},
+		{Port: PortSelector{Number: 9090}},
+		{Port: PortSelector{Name: "grpc"}},
+		{Port: PortSelector{Name: "http"}, ConnectionPool: ConnectionPoolSettings{HTTP: &HTTPSettings{MaxRetries: -1, HTTP2MaxRequests: maxConnectionPoolLimit + 1}}},
+		{Port: PortSelector{Number: 80}, OutlierDetection: OutlierDetection{ConsecutiveErrors: 1, MaxEjectionPercent: 10, Interval: "10s"}},
+	}
+	want := []string{
+		"portLevelSettings[0].port",
+		"portLevelSettings[1].port.name",
+		"portLevelSettings[2].port.number",
+		"portLevelSettings[3].port.name",
+		"portLevelSettings[5].port",
+		"portLevelSettings[6].connectionPool.http.http2MaxRequests",
+		"portLevelSettings[6].connectionPool.http.maxRetries",
+		"portLevelSettings[7].port",
+		"portLevelSettings[7].outlierDetection.baseEjectionTime",
+	}
+	errs := validatePortLevelSettings(invalid, ports, field.NewPath("portLevelSettings"))
+	if len(errs) != len(want) {
+		t.Fatalf("expected %d errors, got %v", len(want), errs)
+	}
+	for i, err := range errs {
+		if err.Field != want[i] {
+			t.Errorf("expected error for %s, got %v", want[i], err)
+		}
+	}
+}
+
+func TestValidateDuration(t *testing.T) {
+	for _, value := range []string{"500ms", "1s", "1.5s", "1m", "1h30m"} {
+		if errs := validateDuration(value, parseDuration, time.Millisecond, 24*time.Hour, field.NewPath("interval")); len(errs) != 0 {
+			t.Errorf("expected %q to be valid, got %v", value, errs)
+		}
+	}
+	for _, value := range []string{"", "0s", "10", "1|", "-1s", "1.5ms", "1d", "1x"} {
+		if errs := validateDuration(value, parseDuration, time.Millisecond, 24*time.Hour, field.NewPath("interval")); len(errs) != 1 {
+			t.Errorf("expected %q to be rejected, got %v", value, errs)
+		}
+	}
+
+	// only rate limits accept days
+	for _, value := range []string{"1s", "1h30m", "1d"} {
+		if errs := validateDuration(value, parseDayDuration, time.Millisecond, 24*time.Hour, field.NewPath("timeDuration")); len(errs) != 0 {
+			t.Errorf("expected %q to be valid, got %v", value, errs)
+		}
+	}
+	for _, value := range []string{"2d", "1.5d", "-1d", "d"} {
+		if errs := validateDuration(value, parseDayDuration, time.Millisecond, 24*time.Hour, field.NewPath("timeDuration")); len(errs) != 1 {
+			t.Errorf("expected %q to be rejected, got %v", value, errs)
+		}
+	}
+}
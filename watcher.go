@@ -0,0 +1,56 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+)
+
+// watchFiles calls onChange whenever one of files may have changed, until stop
+// is closed. The parent directories are watched rather than the files
+// themselves because Secret and ConfigMap volumes are updated by atomically
+// swapping a symlink, which a watch on the old file would never see.
+func watchFiles(files []string, stop <-chan struct{}, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	dirs := map[string]bool{}
+	for _, file := range files {
+		dir := filepath.Dir(file)
+		if dirs[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+		dirs[dir] = true
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+					glog.V(4).Infof("Watched file event: %v", event)
+					onChange()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				glog.Errorf("File watcher error: %v", err)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
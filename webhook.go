@@ -6,16 +6,26 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
+	"sync/atomic"
 
 	"github.com/ghodss/yaml"
 	"github.com/golang/glog"
+	admissionv1 "k8s.io/api/admission/v1"
 	"k8s.io/api/admission/v1beta1"
 	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 )
 
 var (
@@ -28,7 +38,25 @@ var (
 )
 
 type Config struct {
-	Containers []corev1.Container `yaml:"containers"`
+	InitContainers   []corev1.Container            `yaml:"initContainers"`
+	Containers       []corev1.Container            `yaml:"containers"`
+	Volumes          []corev1.Volume               `yaml:"volumes"`
+	ImagePullSecrets []corev1.LocalObjectReference `yaml:"imagePullSecrets"`
+	// Env is added to every container that already exists in the Pod
+	Env []corev1.EnvVar `yaml:"env"`
+
+	// Profiles are named injection profiles a Pod selects through the inject
+	// annotation instead of the sidecars above
+	Profiles map[string]*Config `yaml:"profiles"`
+	// NamespaceProfiles lists the profiles injected into the Pods of a
+	// namespace that do not select any themselves
+	NamespaceProfiles map[string][]string `yaml:"namespaceProfiles"`
+
+	// sha256 is the checksum of the file the config was loaded from
+	sha256 string
+	// source is the config file. Its string fields are templates rendered
+	// once per Pod
+	source []byte
 }
 
 var (
@@ -44,21 +72,28 @@ var (
 		partOfLabel,
 		managedByLabel,
 	}
-	/*addLabels = map[string]string{
+	addLabels = map[string]string{
 		nameLabel:      NA,
 		instanceLabel:  NA,
 		versionLabel:   NA,
 		componentLabel: NA,
 		partOfLabel:    NA,
 		managedByLabel: NA,
-	}*/
+	}
 )
 
 const (
 	admissionWebhookAnnotationValidateKey = "admission-webhook-example.qikqiak.com/validate"
 	admissionWebhookAnnotationMutateKey   = "admission-webhook-example.qikqiak.com/mutate"
 	admissionWebhookAnnotationStatusKey   = "admission-webhook-example.qikqiak.com/status"
+	admissionWebhookAnnotationInjectKey   = "admission-webhook-example.qikqiak.com/inject"
 	admissionWebhookAnnotationPodNoCreate = "admission-webhook-example.qikqiak.com/podnocreate"
+	// acknowledges a change of the ingress host of an Application
+	admissionWebhookAnnotationIngressHostKey = "admission-webhook-example.qikqiak.com/ingress-host"
+	// allows Applications to share an ingress host and path
+	admissionWebhookAnnotationSharedIngressKey = "admission-webhook-example.qikqiak.com/shared-ingress"
+	// values of component parameters, a JSON object keyed by parameter name
+	admissionWebhookAnnotationParametersKey = "admission-webhook-example.qikqiak.com/parameters"
 
 	nameLabel      = "app.kubernetes.io/name"
 	instanceLabel  = "app.kubernetes.io/instance"
@@ -71,8 +106,13 @@ const (
 )
 
 type WebhookServer struct {
-	sidecarConfig *Config
-	server        *http.Server
+	sidecarConfig  atomic.Pointer[Config]
+	sidecarCfgFile string
+	policy         atomic.Pointer[Policy]
+	policyFile     string
+	quota          *quotaChecker // nil unless quota checks are enabled
+	ingress        *ingressIndex // nil unless ingress checks are enabled
+	server         *http.Server
 }
 
 // Webhook Server parameters
@@ -81,6 +121,10 @@ type WhSvrParameters struct {
 	certFile       string // path to the x509 certificate for https
 	keyFile        string // path to the x509 private key matching `CertFile`
 	sidecarCfgFile string // path to sidecar injector configuration file
+	policyFile     string // path to validation policy file, the built-in policy if empty
+	quotaCheck     bool   // check Applications against the ResourceQuotas of their namespace
+	ingressCheck   bool   // check that Applications do not claim the ingress of another one
+	appResource    string // resource.version.group of Applications
 }
 
 type patchOperation struct {
@@ -91,6 +135,8 @@ type patchOperation struct {
 
 func init() {
 	_ = corev1.AddToScheme(runtimeScheme)
+	_ = admissionv1.AddToScheme(runtimeScheme)
+	_ = v1beta1.AddToScheme(runtimeScheme)
 	_ = admissionregistrationv1beta1.AddToScheme(runtimeScheme)
 	// defaulting with webhooks:
 	// https://github.com/kubernetes/kubernetes/issues/57982
@@ -143,102 +189,328 @@ func validationRequired(ignoredList []string, metadata *metav1.ObjectMeta) bool
 }
 
 func updateAnnotation(target map[string]string, added map[string]string) (patch []patchOperation) {
-	for key, value := range added {
-		/*		if target == nil || target[key] == "" {
-				target[key] = value
-			} else {*/
-		target[key] = value
-		//}
-	}
-	patch = append(patch, patchOperation{
-		Op:    "add",
-		Path:  "/metadata/annotations",
-		Value: target,
-	})
+	if target == nil {
+		return append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/metadata/annotations",
+			Value: added,
+		})
+	}
+	keys := make([]string, 0, len(added))
+	for key := range added {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/metadata/annotations/" + escapeJSONPointer(key),
+			Value: added[key],
+		})
+	}
 	return patch
 }
 
-func updateLabels(target map[string]string, added map[string]string) (patch []patchOperation) {
-	for key, value := range added {
-		/*if target == nil || target[key] == "" {
-			target[key] = value
-		} else {*/
-		target[key] = value
-		//}
+// escapeJSONPointer escapes a map key for use as a JSON pointer (RFC 6901) token.
+func escapeJSONPointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
+
+// updateLabels adds the labels of added that target does not have yet. Existing
+// labels are never overwritten.
+func updateLabels(target map[string]string, added map[string]string, basePath string) (patch []patchOperation) {
+	keys := make([]string, 0, len(added))
+	for key := range added {
+		if _, ok := target[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+	if target == nil {
+		missing := map[string]string{}
+		for _, key := range keys {
+			missing[key] = added[key]
+		}
+		return append(patch, patchOperation{
+			Op:    "add",
+			Path:  basePath,
+			Value: missing,
+		})
+	}
+	for _, key := range keys {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  basePath + "/" + escapeJSONPointer(key),
+			Value: added[key],
+		})
 	}
-	patch = append(patch, patchOperation{
-		Op:    "add",
-		Path:  "/spec/template/metadata/labels",
-		Value: target,
-	})
 	return patch
 }
 
-func createPatch(availableAnnotations map[string]string, annotations map[string]string, availableLabels map[string]string, labels map[string]string) ([]byte, error) {
+// createPatch adds the missing labels to an object and, for workloads, to its
+// Pod template. It returns nil if nothing needs to change.
+func createPatch(metadata *metav1.ObjectMeta, template *corev1.PodTemplateSpec, labels map[string]string) ([]byte, error) {
 	var patch []patchOperation
 
-	//patch = append(patch, updateAnnotation(availableAnnotations, annotations)...)
-	patch = append(patch, updateLabels(availableLabels, labels)...)
-	//patch = append(patch, updateSpecTemplateMetadateLabels(podavailableLabels, labels)...)
+	patch = append(patch, updateLabels(metadata.Labels, labels, "/metadata/labels")...)
+	if template != nil {
+		patch = append(patch, updateLabels(template.Labels, labels, "/spec/template/metadata/labels")...)
+	}
+	if len(patch) == 0 {
+		return nil, nil
+	}
 
 	return json.Marshal(patch)
 }
 
-// validate deployments and services
-func (whsvr *WebhookServer) validate(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
-	req := ar.Request
+// validateRequiredLabels reports every required label the object does not set.
+func validateRequiredLabels(metadata *metav1.ObjectMeta) field.ErrorList {
+	allErrs := field.ErrorList{}
+	for _, label := range requiredLabels {
+		if _, ok := metadata.Labels[label]; !ok {
+			allErrs = append(allErrs, field.Required(field.NewPath("metadata", "labels").Key(label), "required label is not set"))
+		}
+	}
+	return allErrs
+}
+
+// decodeLabeledObject decodes the objects that must carry the required labels
+// and returns their metadata and, for workloads, their Pod template.
+func decodeLabeledObject(kind string, raw []byte) (*metav1.ObjectMeta, *corev1.PodTemplateSpec, error) {
+	switch kind {
+	case "Deployment":
+		var deployment appsv1.Deployment
+		if err := json.Unmarshal(raw, &deployment); err != nil {
+			return nil, nil, err
+		}
+		return &deployment.ObjectMeta, &deployment.Spec.Template, nil
+	case "StatefulSet":
+		var statefulSet appsv1.StatefulSet
+		if err := json.Unmarshal(raw, &statefulSet); err != nil {
+			return nil, nil, err
+		}
+		return &statefulSet.ObjectMeta, &statefulSet.Spec.Template, nil
+	case "DaemonSet":
+		var daemonSet appsv1.DaemonSet
+		if err := json.Unmarshal(raw, &daemonSet); err != nil {
+			return nil, nil, err
+		}
+		return &daemonSet.ObjectMeta, &daemonSet.Spec.Template, nil
+	case "Job":
+		var job batchv1.Job
+		if err := json.Unmarshal(raw, &job); err != nil {
+			return nil, nil, err
+		}
+		return &job.ObjectMeta, &job.Spec.Template, nil
+	case "Service":
+		var service corev1.Service
+		if err := json.Unmarshal(raw, &service); err != nil {
+			return nil, nil, err
+		}
+		return &service.ObjectMeta, nil, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported kind %s", kind)
+}
+
+// validate applications, pods, workloads and services
+func (whsvr *WebhookServer) validate(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
 	glog.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v patchOperation=%v",
 		req.Kind, req.Namespace, req.Name, req.Operation)
 	allowed := true
 	var result *metav1.Status
-	if req.Kind.Kind == "Application" {
+	var warnings []string
+	policy := whsvr.policy.Load()
+	switch req.Kind.Kind {
+	case "Pod":
+		var pod corev1.Pod
+		if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+			glog.Errorf("Could not unmarshal raw object: %v", err)
+			return &admissionv1.AdmissionResponse{
+				Result: &metav1.Status{
+					Message: err.Error(),
+				},
+			}
+		}
+		if pod.Namespace == "" {
+			pod.Namespace = req.Namespace
+		}
+		// the policy is enforced whatever the validate annotation says.
+		// Validating webhooks run after the mutating ones, so this also
+		// checks the injected sidecars
+		violations := policy.Evaluate(req.Kind.Kind, pod.Namespace, req.Object.Raw)
+		violations = append(violations, policy.EvaluateImages(pod.Namespace, podSpecImages(&pod.Spec, field.NewPath("spec")))...)
+		logPolicyDecisions(req, pod.Name, violations)
+		errs, policyWarnings := splitViolations(violations)
+		warnings = policyWarnings
+		if len(errs) != 0 {
+			allowed = false
+			status := apierrors.NewInvalid(schema.GroupKind{Group: req.Kind.Group, Kind: req.Kind.Kind}, pod.Name, errs).Status()
+			result = &status
+		}
+	case "Deployment", "StatefulSet", "DaemonSet", "Job", "Service":
+		objectMeta, template, err := decodeLabeledObject(req.Kind.Kind, req.Object.Raw)
+		if err != nil {
+			glog.Errorf("Could not unmarshal raw object: %v", err)
+			return &admissionv1.AdmissionResponse{
+				Result: &metav1.Status{
+					Message: err.Error(),
+				},
+			}
+		}
+		if objectMeta.Namespace == "" {
+			objectMeta.Namespace = req.Namespace
+		}
+		// the policy is enforced whatever the validate annotation says, which
+		// only opts out of the required labels
+		violations := policy.Evaluate(req.Kind.Kind, objectMeta.Namespace, req.Object.Raw)
+		if template != nil {
+			violations = append(violations, policy.EvaluateImages(objectMeta.Namespace, podSpecImages(&template.Spec, field.NewPath("spec", "template", "spec")))...)
+		}
+		logPolicyDecisions(req, objectMeta.Name, violations)
+		policyErrs, policyWarnings := splitViolations(violations)
+		warnings = policyWarnings
+		errs := field.ErrorList{}
+		if validationRequired(ignoredNamespaces, objectMeta) {
+			errs = validateRequiredLabels(objectMeta)
+		} else {
+			glog.Infof("Skipping required labels for %s/%s due to policy check", objectMeta.Namespace, objectMeta.Name)
+		}
+		errs = append(errs, policyErrs...)
+		if len(errs) != 0 {
+			allowed = false
+			status := apierrors.NewInvalid(schema.GroupKind{Group: req.Kind.Group, Kind: req.Kind.Kind}, objectMeta.Name, errs).Status()
+			result = &status
+		}
+	case "Application":
 		var application Application
 		if err := json.Unmarshal(req.Object.Raw, &application); err != nil {
 			glog.Errorf("Could not unmarshal raw object: %v", err)
-			return &v1beta1.AdmissionResponse{
+			return &admissionv1.AdmissionResponse{
 				Result: &metav1.Status{
 					Message: err.Error(),
 				},
 			}
 		}
 		glog.Infoln(application)
-		err := application.Validation()
-		if err != nil {
-			allowed = false
-			result = &metav1.Status{
-				Reason:  "Data validation failed",
-				Message: err.Error(),
+		if application.Namespace == "" {
+			application.Namespace = req.Namespace
+		}
+		violations := policy.Evaluate(req.Kind.Kind, application.Namespace, req.Object.Raw)
+		violations = append(violations, policy.EvaluateImages(application.Namespace, applicationImages(&application))...)
+		violations = append(violations, policy.EvaluateResources(application.Namespace, &application)...)
+		violations = append(violations, policy.EvaluateRetries(application.Namespace, &application)...)
+		logPolicyDecisions(req, application.Name, violations)
+		policyErrs, policyWarnings := splitViolations(violations)
+		warnings = policyWarnings
+		errs := application.Validation()
+		var old *Application
+		if req.Operation == admissionv1.Update {
+			old = &Application{}
+			if err := json.Unmarshal(req.OldObject.Raw, old); err != nil {
+				glog.Errorf("Could not unmarshal raw old object: %v", err)
+				return &admissionv1.AdmissionResponse{
+					Result: &metav1.Status{
+						Message: err.Error(),
+					},
+				}
 			}
+			errs = append(errs, application.ValidationUpdate(old)...)
 		}
+		errs = append(errs, whsvr.quota.Check(application.Namespace, &application, old)...)
+		errs = append(errs, whsvr.ingress.Check(&application)...)
+		errs = append(errs, policyErrs...)
+		if len(errs) != 0 {
+			allowed = false
+			status := apierrors.NewInvalid(schema.GroupKind{Group: req.Kind.Group, Kind: req.Kind.Kind}, application.Name, errs).Status()
+			result = &status
+		}
+	}
+	return &admissionv1.AdmissionResponse{
+		Allowed:  allowed,
+		Result:   result,
+		Warnings: warnings,
 	}
-	return &v1beta1.AdmissionResponse{
-		Allowed: allowed,
-		Result:  result,
+}
+
+// logPolicyDecisions records every policy violation in the decision log,
+// whatever the mode of the rule.
+func logPolicyDecisions(req *admissionv1.AdmissionRequest, name string, violations []PolicyViolation) {
+	for _, v := range violations {
+		glog.Infof("Policy decision: rule=%q mode=%s kind=%s namespace=%s name=%s uid=%s operation=%s: %v",
+			v.Rule, v.Mode, req.Kind.Kind, req.Namespace, name, req.UID, req.Operation, v.Err)
 	}
 }
 
 // main mutation process
-func (whsvr *WebhookServer) mutate(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
-	req := ar.Request
+func (whsvr *WebhookServer) mutate(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	var (
+		objectMeta *metav1.ObjectMeta
+		template   *corev1.PodTemplateSpec
+	)
 	switch req.Kind.Kind {
-	/*case "Deployment":
-	var deployment appsv1.Deployment
-	if err := json.Unmarshal(req.Object.Raw, &deployment); err != nil {
-		glog.Errorf("Could not unmarshal raw object: %v", err)
-		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
+	case "Deployment", "StatefulSet", "DaemonSet", "Job", "Service":
+		var err error
+		objectMeta, template, err = decodeLabeledObject(req.Kind.Kind, req.Object.Raw)
+		if err != nil {
+			glog.Errorf("Could not unmarshal raw object: %v", err)
+			return &admissionv1.AdmissionResponse{
+				Result: &metav1.Status{
+					Message: err.Error(),
+				},
+			}
+		}
+	case "Application":
+		var application Application
+		if err := json.Unmarshal(req.Object.Raw, &application); err != nil {
+			glog.Errorf("Could not unmarshal raw object: %v", err)
+			return &admissionv1.AdmissionResponse{
+				Result: &metav1.Status{
+					Message: err.Error(),
+				},
+			}
+		}
+		glog.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v UID=%v patchOperation=%v UserInfo=%v",
+			req.Kind, req.Namespace, req.Name, req.UID, req.Operation, req.UserInfo)
+		if application.Namespace == "" {
+			application.Namespace = req.Namespace
+		}
+		if !mutationRequired(ignoredNamespaces, &application.ObjectMeta) {
+			glog.Infof("Skipping mutation for %s/%s due to policy check", application.Namespace, application.Name)
+			return &admissionv1.AdmissionResponse{
+				Allowed: true,
+			}
+		}
+		patchBytes, err := createApplicationPatch(&application)
+		if err != nil {
+			return &admissionv1.AdmissionResponse{
+				Result: &metav1.Status{
+					Message: err.Error(),
+				},
+			}
+		}
+		if patchBytes == nil {
+			return &admissionv1.AdmissionResponse{
+				Allowed: true,
+			}
+		}
+
+		glog.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
+		return &admissionv1.AdmissionResponse{
+			Allowed: true,
+			Patch:   patchBytes,
+			PatchType: func() *admissionv1.PatchType {
+				pt := admissionv1.PatchTypeJSONPatch
+				return &pt
+			}(),
 		}
-	}
-	resourceName, resourceNamespace, objectMeta = deployment.Name, deployment.Namespace, &deployment.ObjectMeta
-	availableLabels = deployment.Labels
-	availableAnnotations = deployment.Annotations*/
 	case "Pod":
 		var pod corev1.Pod
 		if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
 			glog.Errorf("Could not unmarshal raw object: %v", err)
-			return &v1beta1.AdmissionResponse{
+			return &admissionv1.AdmissionResponse{
 				Result: &metav1.Status{
 					Message: err.Error(),
 				},
@@ -246,23 +518,41 @@ func (whsvr *WebhookServer) mutate(ar *v1beta1.AdmissionReview) *v1beta1.Admissi
 		}
 		glog.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v",
 			req.Kind, req.Namespace, req.Name, pod.Name, req.UID, req.Operation, req.UserInfo)
+		if pod.Namespace == "" {
+			pod.Namespace = req.Namespace
+		}
 		if !mutationRequired(ignoredNamespaces, &pod.ObjectMeta) {
 			glog.Infof("Skipping mutation for %s/%s due to policy check", pod.Namespace, pod.Name)
-			return &v1beta1.AdmissionResponse{
+			return &admissionv1.AdmissionResponse{
 				Allowed: true,
 			}
 		}
-		if len(pod.Annotations) == 0 {
-			pod.Annotations = map[string]string{admissionWebhookAnnotationStatusKey: "injected"}
-		} else {
-			pod.Annotations[admissionWebhookAnnotationStatusKey] = "injected"
+		sidecarConfig := whsvr.sidecarConfig.Load()
+		if sidecarConfig == nil {
+			sidecarConfig = &Config{}
 		}
-
-		//applyDefaultsWorkaround(whsvr.sidecarConfig.Containers)
-		//annotations := map[string]string{admissionWebhookAnnotationStatusKey: "injected"}
-		/*patchBytes, err := createPodPatch(&pod, whsvr.sidecarConfig, annotations)
+		sidecarConfig, err := sidecarConfig.render(&pod)
+		if err != nil {
+			glog.Errorf("Could not render sidecar configuration for %s/%s: %v", pod.Namespace, pod.Name, err)
+			return &admissionv1.AdmissionResponse{
+				Result: &metav1.Status{
+					Message: fmt.Sprintf("failed to render sidecar configuration: %v", err),
+				},
+			}
+		}
+		sidecarConfig, err = sidecarConfig.selectProfiles(&pod)
 		if err != nil {
-			return &v1beta1.AdmissionResponse{
+			glog.Errorf("Could not select sidecar profiles for %s/%s: %v", pod.Namespace, pod.Name, err)
+			return &admissionv1.AdmissionResponse{
+				Result: &metav1.Status{
+					Message: err.Error(),
+				},
+			}
+		}
+		annotations := map[string]string{admissionWebhookAnnotationStatusKey: "injected"}
+		patchBytes, err := createPodPatch(&pod, sidecarConfig, annotations)
+		if err != nil {
+			return &admissionv1.AdmissionResponse{
 				Result: &metav1.Status{
 					Message: err.Error(),
 				},
@@ -270,30 +560,54 @@ func (whsvr *WebhookServer) mutate(ar *v1beta1.AdmissionReview) *v1beta1.Admissi
 		}
 
 		glog.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
-		return &v1beta1.AdmissionResponse{
+		return &admissionv1.AdmissionResponse{
 			Allowed: true,
 			Patch:   patchBytes,
-			PatchType: func() *v1beta1.PatchType {
-				pt := v1beta1.PatchTypeJSONPatch
+			PatchType: func() *admissionv1.PatchType {
+				pt := admissionv1.PatchTypeJSONPatch
 				return &pt
 			}(),
-		}*/
-		//podavailableLabels = deployment.Spec.Template.Labels
-		/*case "Service":
-		var service corev1.Service
-		if err := json.Unmarshal(req.Object.Raw, &service); err != nil {
-			glog.Errorf("Could not unmarshal raw object: %v", err)
-			return &v1beta1.AdmissionResponse{
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
 		}
-		resourceName, resourceNamespace, objectMeta = service.Name, service.Namespace, &service.ObjectMeta
-		availableLabels = service.Labels
-		availableAnnotations = service.Annotations*/
+	default:
+		return &admissionv1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	glog.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v UID=%v patchOperation=%v UserInfo=%v",
+		req.Kind, req.Namespace, req.Name, req.UID, req.Operation, req.UserInfo)
+	if objectMeta.Namespace == "" {
+		objectMeta.Namespace = req.Namespace
+	}
+	if !mutationRequired(ignoredNamespaces, objectMeta) {
+		glog.Infof("Skipping mutation for %s/%s due to policy check", objectMeta.Namespace, objectMeta.Name)
+		return &admissionv1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+	patchBytes, err := createPatch(objectMeta, template, addLabels)
+	if err != nil {
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	}
+	if patchBytes == nil {
+		return &admissionv1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	glog.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
+	return &admissionv1.AdmissionResponse{
+		Allowed: true,
+		Patch:   patchBytes,
+		PatchType: func() *admissionv1.PatchType {
+			pt := admissionv1.PatchTypeJSONPatch
+			return &pt
+		}(),
 	}
-	return nil
 }
 
 // Serve method for webhook server
@@ -318,33 +632,40 @@ func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var admissionResponse *v1beta1.AdmissionResponse
-	ar := v1beta1.AdmissionReview{}
-	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
+	var admit admitFunc
+	switch r.URL.Path {
+	case "/mutate":
+		admit = whsvr.mutate
+	case "/validate":
+		admit = whsvr.validate
+	default:
+		glog.Errorf("Unknown webhook path %s", r.URL.Path)
+		http.Error(w, fmt.Sprintf("unknown webhook path %s", r.URL.Path), http.StatusNotFound)
+		return
+	}
+
+	req, encode, err := reviewRequest(body)
+	if err != nil {
 		glog.Errorf("Can't decode body: %v", err)
-		admissionResponse = &v1beta1.AdmissionResponse{
+		http.Error(w, fmt.Sprintf("could not decode body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var admissionResponse *admissionv1.AdmissionResponse
+	if req == nil {
+		admissionResponse = &admissionv1.AdmissionResponse{
 			Result: &metav1.Status{
-				Message: err.Error(),
+				Message: "empty admission request",
 			},
 		}
 	} else {
-		fmt.Println(r.URL.Path)
-		if r.URL.Path == "/mutate" {
-			admissionResponse = whsvr.mutate(&ar)
-		} else if r.URL.Path == "/validate" {
-			admissionResponse = whsvr.validate(&ar)
+		admissionResponse = admit(req)
+		if admissionResponse != nil {
+			admissionResponse.UID = req.UID
 		}
 	}
 
-	admissionReview := v1beta1.AdmissionReview{}
-	if admissionResponse != nil {
-		admissionReview.Response = admissionResponse
-		if ar.Request != nil {
-			admissionReview.Response.UID = ar.Request.UID
-		}
-	}
-
-	resp, err := json.Marshal(admissionReview)
+	resp, err := json.Marshal(encode(admissionResponse))
 	if err != nil {
 		glog.Errorf("Can't encode response: %v", err)
 		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
@@ -357,10 +678,12 @@ func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
 }
 
 //zk
-func applyDefaultsWorkaround(containers []corev1.Container) {
+func applyDefaultsWorkaround(initContainers, containers []corev1.Container, volumes []corev1.Volume) {
 	defaulter.Default(&corev1.Pod{
 		Spec: corev1.PodSpec{
-			Containers: containers,
+			InitContainers: initContainers,
+			Containers:     containers,
+			Volumes:        volumes,
 		},
 	})
 }
@@ -370,20 +693,214 @@ func loadConfig(configFile string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	glog.Infof("New configuration: sha256sum %x", sha256.Sum256(data))
 
+	// render against an empty Pod so that a broken template is rejected at
+	// load time rather than on the first admission request
+	cfg, err := renderConfig(data, &corev1.Pod{})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath.Base(configFile), err)
+	}
+	cfg.source = data
+	cfg.sha256 = fmt.Sprintf("%x", sha256.Sum256(data))
+	glog.Infof("New configuration: sha256sum %s", cfg.sha256)
+
+	return cfg, nil
+}
+
+// renderConfig parses data and then renders its string fields for pod, so
+// the values of the Pod cannot change the structure of the config.
+func renderConfig(data []byte, pod *corev1.Pod) (*Config, error) {
 	var cfg Config
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
-
+	if err := renderStrings(reflect.ValueOf(&cfg), newSidecarTemplateData(pod)); err != nil {
+		return nil, err
+	}
+	if errs := cfg.validate(); len(errs) != 0 {
+		return nil, errs.ToAggregate()
+	}
+	applyDefaultsWorkaround(cfg.InitContainers, cfg.Containers, cfg.Volumes)
+	for _, profile := range cfg.Profiles {
+		applyDefaultsWorkaround(profile.InitContainers, profile.Containers, profile.Volumes)
+	}
 	return &cfg, nil
 }
 
-func addContainer(target, added []corev1.Container, basePath string) (patch []patchOperation) {
+// render returns the config rendered for pod. A config that was not loaded
+// from a template is returned as is.
+func (cfg *Config) render(pod *corev1.Pod) (*Config, error) {
+	if cfg.source == nil {
+		return cfg, nil
+	}
+	rendered, err := renderConfig(cfg.source, pod)
+	if err != nil {
+		return nil, err
+	}
+	rendered.source, rendered.sha256 = cfg.source, cfg.sha256
+	return rendered, nil
+}
+
+func (cfg *Config) validate() field.ErrorList {
+	allErrs := validateProfile(cfg, nil)
+
+	names := make([]string, 0, len(cfg.Profiles))
+	for name := range cfg.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fldPath := field.NewPath("profiles").Key(name)
+		profile := cfg.Profiles[name]
+		if profile == nil {
+			allErrs = append(allErrs, field.Required(fldPath, ""))
+			continue
+		}
+		if len(profile.Profiles) != 0 || len(profile.NamespaceProfiles) != 0 {
+			allErrs = append(allErrs, field.Forbidden(fldPath, "profiles cannot be nested"))
+		}
+		allErrs = append(allErrs, validateProfile(profile, fldPath)...)
+	}
+
+	for namespace, profiles := range cfg.NamespaceProfiles {
+		for i, name := range profiles {
+			if _, ok := cfg.Profiles[name]; !ok {
+				allErrs = append(allErrs, field.NotFound(field.NewPath("namespaceProfiles").Key(namespace).Index(i), name))
+			}
+		}
+	}
+	return allErrs
+}
+
+// validateProfile checks the sidecars of a single profile. fldPath is nil for
+// the top-level one.
+func validateProfile(cfg *Config, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	// init containers and containers share one name space within a Pod
+	containerNames := map[string]bool{}
+	allErrs = append(allErrs, validateSidecarContainers(cfg.InitContainers, containerNames, fldPath.Child("initContainers"))...)
+	allErrs = append(allErrs, validateSidecarContainers(cfg.Containers, containerNames, fldPath.Child("containers"))...)
+
+	volumeNames := map[string]bool{}
+	for i, v := range cfg.Volumes {
+		allErrs = append(allErrs, validateUniqueName(v.Name, volumeNames, fldPath.Child("volumes").Index(i).Child("name"))...)
+	}
+	secretNames := map[string]bool{}
+	for i, s := range cfg.ImagePullSecrets {
+		allErrs = append(allErrs, validateUniqueName(s.Name, secretNames, fldPath.Child("imagePullSecrets").Index(i).Child("name"))...)
+	}
+	envNames := map[string]bool{}
+	for i, e := range cfg.Env {
+		allErrs = append(allErrs, validateUniqueName(e.Name, envNames, fldPath.Child("env").Index(i).Child("name"))...)
+	}
+	return allErrs
+}
+
+// selectProfiles returns the sidecars to inject into pod: the profiles named
+// by its inject annotation, else the defaults of its namespace, else the
+// top-level sidecars.
+func (cfg *Config) selectProfiles(pod *corev1.Pod) (*Config, error) {
+	var names []string
+	if value, ok := pod.Annotations[admissionWebhookAnnotationInjectKey]; ok {
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case "n", "no", "false", "off", "none":
+			glog.Infof("Sidecar injection disabled for %s/%s", pod.Namespace, pod.Name)
+			return &Config{}, nil
+		}
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	} else if defaults, ok := cfg.NamespaceProfiles[pod.Namespace]; ok {
+		names = defaults
+	} else {
+		return cfg, nil
+	}
+
+	// sidecars shared by several profiles are deduplicated by name when the
+	// patch is created
+	selected := &Config{}
+	for _, name := range names {
+		profile, ok := cfg.Profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown sidecar profile %q", name)
+		}
+		selected.InitContainers = append(selected.InitContainers, profile.InitContainers...)
+		selected.Containers = append(selected.Containers, profile.Containers...)
+		selected.Volumes = append(selected.Volumes, profile.Volumes...)
+		selected.ImagePullSecrets = append(selected.ImagePullSecrets, profile.ImagePullSecrets...)
+		selected.Env = append(selected.Env, profile.Env...)
+	}
+	glog.Infof("Injecting sidecar profiles %v into %s/%s", names, pod.Namespace, pod.Name)
+	return selected, nil
+}
+
+func validateSidecarContainers(containers []corev1.Container, names map[string]bool, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	for i, c := range containers {
+		allErrs = append(allErrs, validateUniqueName(c.Name, names, fldPath.Index(i).Child("name"))...)
+		if c.Image == "" {
+			allErrs = append(allErrs, field.Required(fldPath.Index(i).Child("image"), ""))
+		}
+	}
+	return allErrs
+}
+
+func validateUniqueName(name string, names map[string]bool, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if name == "" {
+		allErrs = append(allErrs, field.Required(fldPath, ""))
+	} else if names[name] {
+		allErrs = append(allErrs, field.Duplicate(fldPath, name))
+	}
+	names[name] = true
+	return allErrs
+}
+
+// reloadSidecarConfig loads sidecarCfgFile and swaps it in if it is valid and
+// differs from the active one. On error the active config stays in service.
+func (whsvr *WebhookServer) reloadSidecarConfig() error {
+	cfg, err := loadConfig(whsvr.sidecarCfgFile)
+	if err != nil {
+		return err
+	}
+	if old := whsvr.sidecarConfig.Load(); old != nil && old.sha256 == cfg.sha256 {
+		return nil
+	}
+	whsvr.sidecarConfig.Store(cfg)
+	glog.Infof("Sidecar configuration %s is active: sha256sum %s", whsvr.sidecarCfgFile, cfg.sha256)
+	return nil
+}
+
+// watchSidecarConfig reloads the sidecar config whenever sidecarCfgFile changes.
+func (whsvr *WebhookServer) watchSidecarConfig(stop <-chan struct{}) error {
+	return watchFiles([]string{whsvr.sidecarCfgFile}, stop, func() {
+		if err := whsvr.reloadSidecarConfig(); err != nil {
+			glog.Errorf("Failed to reload sidecar configuration, keeping the previous one: %v", err)
+		}
+	})
+}
+
+// serveConfigSum writes the sha256 of the active sidecar configuration.
+func (whsvr *WebhookServer) serveConfigSum(w http.ResponseWriter, r *http.Request) {
+	cfg := whsvr.sidecarConfig.Load()
+	if cfg == nil {
+		http.Error(w, "no sidecar configuration loaded", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, cfg.sha256)
+}
+
+func addContainer(target, added []corev1.Container, basePath string, existing map[string]bool) (patch []patchOperation) {
 	first := len(target) == 0
 	var value interface{}
 	for _, add := range added {
+		if existing[add.Name] {
+			glog.Infof("Skip container %s, it already exists", add.Name)
+			continue
+		}
+		existing[add.Name] = true
 		value = add
 		path := basePath
 		if first {
@@ -400,9 +917,111 @@ func addContainer(target, added []corev1.Container, basePath string) (patch []pa
 	}
 	return patch
 }
+
+func addVolume(target, added []corev1.Volume, basePath string) (patch []patchOperation) {
+	first := len(target) == 0
+	existing := map[string]bool{}
+	for _, v := range target {
+		existing[v.Name] = true
+	}
+	var value interface{}
+	for _, add := range added {
+		if existing[add.Name] {
+			glog.Infof("Skip volume %s, it already exists", add.Name)
+			continue
+		}
+		existing[add.Name] = true
+		value = add
+		path := basePath
+		if first {
+			first = false
+			value = []corev1.Volume{add}
+		} else {
+			path = path + "/-"
+		}
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  path,
+			Value: value,
+		})
+	}
+	return patch
+}
+
+func addImagePullSecrets(target, added []corev1.LocalObjectReference, basePath string) (patch []patchOperation) {
+	first := len(target) == 0
+	existing := map[string]bool{}
+	for _, s := range target {
+		existing[s.Name] = true
+	}
+	var value interface{}
+	for _, add := range added {
+		if existing[add.Name] {
+			continue
+		}
+		existing[add.Name] = true
+		value = add
+		path := basePath
+		if first {
+			first = false
+			value = []corev1.LocalObjectReference{add}
+		} else {
+			path = path + "/-"
+		}
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  path,
+			Value: value,
+		})
+	}
+	return patch
+}
+
+func addEnv(target, added []corev1.EnvVar, basePath string) (patch []patchOperation) {
+	first := len(target) == 0
+	existing := map[string]bool{}
+	for _, e := range target {
+		existing[e.Name] = true
+	}
+	var value interface{}
+	for _, add := range added {
+		if existing[add.Name] {
+			continue
+		}
+		existing[add.Name] = true
+		value = add
+		path := basePath
+		if first {
+			first = false
+			value = []corev1.EnvVar{add}
+		} else {
+			path = path + "/-"
+		}
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  path,
+			Value: value,
+		})
+	}
+	return patch
+}
+
 func createPodPatch(pod *corev1.Pod, sidecarConfig *Config, annotations map[string]string) ([]byte, error) {
 	var patch []patchOperation
-	patch = append(patch, addContainer(pod.Spec.Containers, sidecarConfig.Containers, "/spec/containers")...)
+	containerNames := map[string]bool{}
+	for _, c := range pod.Spec.InitContainers {
+		containerNames[c.Name] = true
+	}
+	for _, c := range pod.Spec.Containers {
+		containerNames[c.Name] = true
+	}
+	for i, c := range pod.Spec.Containers {
+		patch = append(patch, addEnv(c.Env, sidecarConfig.Env, fmt.Sprintf("/spec/containers/%d/env", i))...)
+	}
+	patch = append(patch, addContainer(pod.Spec.InitContainers, sidecarConfig.InitContainers, "/spec/initContainers", containerNames)...)
+	patch = append(patch, addContainer(pod.Spec.Containers, sidecarConfig.Containers, "/spec/containers", containerNames)...)
+	patch = append(patch, addVolume(pod.Spec.Volumes, sidecarConfig.Volumes, "/spec/volumes")...)
+	patch = append(patch, addImagePullSecrets(pod.Spec.ImagePullSecrets, sidecarConfig.ImagePullSecrets, "/spec/imagePullSecrets")...)
 	patch = append(patch, updateAnnotation(pod.Annotations, annotations)...)
 
 	return json.Marshal(patch)
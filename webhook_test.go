@@ -1 +1,513 @@
 package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func serveReview(t *testing.T, whsvr *WebhookServer, path string, review map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	whsvr.serve(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestServeAnswersInRequestVersion(t *testing.T) {
+	for _, apiVersion := range []string{"admission.k8s.io/v1", "admission.k8s.io/v1beta1"} {
+		review := map[string]interface{}{
+			"apiVersion": apiVersion,
+			"kind":       "AdmissionReview",
+			"request": map[string]interface{}{
+				"uid":       "705ab4f5-6393-11e8-b7cc-42010a800002",
+				"kind":      map[string]interface{}{"group": "", "version": "v1", "kind": "ConfigMap"},
+				"resource":  map[string]interface{}{"group": "", "version": "v1", "resource": "configmaps"},
+				"operation": "CREATE",
+				"object":    map[string]interface{}{"apiVersion": "v1", "kind": "ConfigMap"},
+			},
+		}
+		out := serveReview(t, &WebhookServer{}, "/validate", review)
+		if out["apiVersion"] != apiVersion || out["kind"] != "AdmissionReview" {
+			t.Errorf("%s: got review %v/%v", apiVersion, out["apiVersion"], out["kind"])
+		}
+		resp, _ := out["response"].(map[string]interface{})
+		if resp["uid"] != "705ab4f5-6393-11e8-b7cc-42010a800002" || resp["allowed"] != true {
+			t.Errorf("%s: unexpected response %v", apiVersion, resp)
+		}
+	}
+}
+
+func TestValidateReturnsAllCauses(t *testing.T) {
+	app := validApplication()
+	app.Name = ""
+	app.Spec.Components[0].Containers[0].Image = ""
+	review := map[string]interface{}{
+		"apiVersion": "admission.k8s.io/v1",
+		"kind":       "AdmissionReview",
+		"request": map[string]interface{}{
+			"uid":       "1",
+			"kind":      map[string]interface{}{"group": "qikqiak.com", "version": "v1", "kind": "Application"},
+			"operation": "CREATE",
+			"object":    app,
+		},
+	}
+	out := serveReview(t, &WebhookServer{}, "/validate", review)
+	resp := out["response"].(map[string]interface{})
+	if resp["allowed"] != false {
+		t.Fatalf("expected rejection, got %v", resp)
+	}
+	details := resp["status"].(map[string]interface{})["details"].(map[string]interface{})
+	if causes := details["causes"].([]interface{}); len(causes) != 2 {
+		t.Errorf("expected 2 causes, got %v", causes)
+	}
+}
+
+func TestValidateWarnsInWarnMode(t *testing.T) {
+	const rules = `
+rules:
+- name: ingress-path
+  path: spec.optTraits.ingress.path
+  enum: ["/"]
+  mode: warn
+  namespaceModes:
+    prod: enforce
+`
+	var policy Policy
+	if err := yaml.Unmarshal([]byte(rules), &policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.compile(); err != nil {
+		t.Fatal(err)
+	}
+	whsvr := &WebhookServer{}
+	whsvr.policy.Store(&policy)
+
+	app := validApplication()
+	app.Namespace = ""
+	app.Spec.OptTraits.Ingress.Path = "/api"
+	for namespace, allowed := range map[string]bool{"dev": true, "prod": false} {
+		review := map[string]interface{}{
+			"apiVersion": "admission.k8s.io/v1",
+			"kind":       "AdmissionReview",
+			"request": map[string]interface{}{
+				"uid":       "1",
+				"kind":      map[string]interface{}{"group": "qikqiak.com", "version": "v1", "kind": "Application"},
+				"namespace": namespace,
+				"operation": "CREATE",
+				"object":    app,
+			},
+		}
+		resp := serveReview(t, whsvr, "/validate", review)["response"].(map[string]interface{})
+		if resp["allowed"] != allowed {
+			t.Errorf("%s: expected allowed=%v, got %v", namespace, allowed, resp)
+		}
+		warnings, _ := resp["warnings"].([]interface{})
+		if allowed && (len(warnings) != 1 || !strings.Contains(warnings[0].(string), "spec.optTraits.ingress.path")) {
+			t.Errorf("%s: expected a warning, got %v", namespace, warnings)
+		}
+		if !allowed && len(warnings) != 0 {
+			t.Errorf("%s: expected no warnings, got %v", namespace, warnings)
+		}
+	}
+}
+
+func TestReloadSidecarConfigKeepsLastGood(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sidecarconfig.yaml")
+	whsvr := &WebhookServer{sidecarCfgFile: file}
+
+	good := "containers:\n- name: sidecar-nginx\n  image: socp.io/zk/sidecar:0407\n"
+	if err := ioutil.WriteFile(file, []byte(good), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := whsvr.reloadSidecarConfig(); err != nil {
+		t.Fatal(err)
+	}
+	active := whsvr.sidecarConfig.Load()
+
+	for _, bad := range []string{"containers: [", "containers:\n- name: sidecar-nginx\n"} {
+		if err := ioutil.WriteFile(file, []byte(bad), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := whsvr.reloadSidecarConfig(); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+		if whsvr.sidecarConfig.Load() != active {
+			t.Errorf("active config replaced by %q", bad)
+		}
+	}
+}
+
+func podRequest(t *testing.T, pod *corev1.Pod) *admissionv1.AdmissionRequest {
+	t.Helper()
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &admissionv1.AdmissionRequest{
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Namespace: "default",
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+}
+
+func mutatePatch(t *testing.T, whsvr *WebhookServer, req *admissionv1.AdmissionRequest) []patchOperation {
+	t.Helper()
+	resp := whsvr.mutate(req)
+	if !resp.Allowed {
+		t.Fatalf("mutation rejected: %v", resp.Result)
+	}
+	var patch []patchOperation
+	if len(resp.Patch) != 0 {
+		if err := json.Unmarshal(resp.Patch, &patch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return patch
+}
+
+func TestMutatePodInjectsSidecars(t *testing.T) {
+	whsvr := &WebhookServer{}
+	whsvr.sidecarConfig.Store(&Config{Containers: []corev1.Container{
+		{Name: "sidecar-nginx", Image: "socp.io/zk/sidecar:0407"},
+		{Name: "app", Image: "socp.io/zk/app:v1"},
+	}})
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx"}}},
+	}
+	patch := mutatePatch(t, whsvr, podRequest(t, pod))
+	if len(patch) != 2 {
+		t.Fatalf("expected 2 patch operations, got %v", patch)
+	}
+	if patch[0].Path != "/spec/containers/-" || patch[0].Value.(map[string]interface{})["name"] != "sidecar-nginx" {
+		t.Errorf("unexpected container patch %v", patch[0])
+	}
+	if patch[1].Path != "/metadata/annotations" {
+		t.Errorf("unexpected annotation patch %v", patch[1])
+	}
+
+	pod.Annotations = map[string]string{admissionWebhookAnnotationStatusKey: "injected"}
+	if patch := mutatePatch(t, whsvr, podRequest(t, pod)); len(patch) != 0 {
+		t.Errorf("expected no patch for an injected pod, got %v", patch)
+	}
+}
+
+func TestCreatePodPatchMergesConfig(t *testing.T) {
+	cfg := &Config{
+		InitContainers:   []corev1.Container{{Name: "init-mesh", Image: "socp.io/mesh/init:v1"}},
+		Containers:       []corev1.Container{{Name: "logagent", Image: "socp.io/log/agent:v1"}},
+		Volumes:          []corev1.Volume{{Name: "logs"}, {Name: "data"}},
+		ImagePullSecrets: []corev1.LocalObjectReference{{Name: "socp-registry"}},
+		Env:              []corev1.EnvVar{{Name: "LOG_DIR", Value: "/var/log/app"}, {Name: "MESH", Value: "on"}},
+	}
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		Containers: []corev1.Container{
+			{Name: "app", Env: []corev1.EnvVar{{Name: "MESH", Value: "off"}}},
+			{Name: "logagent"},
+		},
+		Volumes: []corev1.Volume{{Name: "data"}},
+	}}
+	patchBytes, err := createPodPatch(pod, cfg, map[string]string{admissionWebhookAnnotationStatusKey: "injected"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var patch []patchOperation
+	if err := json.Unmarshal(patchBytes, &patch); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, p := range patch {
+		paths = append(paths, p.Path)
+	}
+	want := []string{
+		"/spec/containers/0/env/-",
+		"/spec/containers/1/env",
+		"/spec/containers/1/env/-",
+		"/spec/initContainers",
+		"/spec/volumes/-",
+		"/spec/imagePullSecrets",
+		"/metadata/annotations",
+	}
+	if strings.Join(paths, ",") != strings.Join(want, ",") {
+		t.Errorf("got paths %v, want %v", paths, want)
+	}
+}
+
+func TestMutatePodRendersTemplate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sidecarconfig.yaml")
+	tmpl := `containers:
+- name: logagent
+  image: 'socp.io/log/agent:{{ .ObjectMeta.Labels "app.kubernetes.io/version" }}'
+  args: ['--app={{ .ObjectMeta.Labels "app.kubernetes.io/name" }}', '--namespace={{ .ObjectMeta.Namespace }}', '--tags={{ .ObjectMeta.Annotations "tags" }}']
+  env:
+  - name: BROKEN
+    value: '{{ if .ObjectMeta.Annotations "broken" }}{{ index .Spec.Containers 5 }}{{ end }}'
+`
+	if err := ioutil.WriteFile(file, []byte(tmpl), 0600); err != nil {
+		t.Fatal(err)
+	}
+	whsvr := &WebhookServer{sidecarCfgFile: file}
+	if err := whsvr.reloadSidecarConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo", Labels: map[string]string{
+			"app.kubernetes.io/name":    "demo",
+			"app.kubernetes.io/version": "v2",
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+	patch := mutatePatch(t, whsvr, podRequest(t, pod))
+	sidecar := patch[0].Value.(map[string]interface{})
+	if sidecar["image"] != "socp.io/log/agent:v2" {
+		t.Errorf("unexpected image %v", sidecar["image"])
+	}
+	if args := sidecar["args"].([]interface{}); args[0] != "--app=demo" || args[1] != "--namespace=default" {
+		t.Errorf("unexpected args %v", args)
+	}
+
+	// values of the Pod cannot change the structure of the config
+	const injected = "a\"]\n  securityContext: {privileged: true}\n  x: [\""
+	pod.Annotations = map[string]string{"tags": injected}
+	sidecar = mutatePatch(t, whsvr, podRequest(t, pod))[0].Value.(map[string]interface{})
+	if _, ok := sidecar["securityContext"]; ok {
+		t.Errorf("annotation changed the sidecar: %v", sidecar)
+	}
+	if args := sidecar["args"].([]interface{}); len(args) != 3 || args[2] != "--tags="+injected {
+		t.Errorf("unexpected args %v", args)
+	}
+
+	pod.Annotations = map[string]string{"broken": "true"}
+	resp := whsvr.mutate(podRequest(t, pod))
+	if resp.Allowed || !strings.Contains(resp.Result.Message, "failed to render sidecar configuration") {
+		t.Errorf("expected render error, got %v", resp)
+	}
+}
+
+func TestSelectProfiles(t *testing.T) {
+	cfg := &Config{
+		Containers: []corev1.Container{{Name: "default-agent", Image: "socp.io/zk/agent:v1"}},
+		Profiles: map[string]*Config{
+			"envoy":    {Containers: []corev1.Container{{Name: "envoy", Image: "socp.io/mesh/envoy:v1"}}, Volumes: []corev1.Volume{{Name: "shared"}}},
+			"logagent": {Containers: []corev1.Container{{Name: "logagent", Image: "socp.io/log/agent:v1"}}, Volumes: []corev1.Volume{{Name: "shared"}}},
+		},
+		NamespaceProfiles: map[string][]string{"team-a": {"logagent"}},
+	}
+	if errs := cfg.validate(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	tests := []struct {
+		namespace  string
+		annotation string
+		want       []string
+	}{
+		{namespace: "default", want: []string{"default-agent"}},
+		{namespace: "team-a", want: []string{"logagent"}},
+		{namespace: "team-a", annotation: "envoy, logagent", want: []string{"envoy", "logagent"}},
+		{namespace: "team-a", annotation: "none"},
+	}
+	for _, test := range tests {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: test.namespace}}
+		if test.annotation != "" {
+			pod.Annotations = map[string]string{admissionWebhookAnnotationInjectKey: test.annotation}
+		}
+		selected, err := cfg.selectProfiles(pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, c := range selected.Containers {
+			names = append(names, c.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%s/%q: got %v, want %v", test.namespace, test.annotation, names, test.want)
+		}
+	}
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{admissionWebhookAnnotationInjectKey: "metrics"}}}
+	if _, err := cfg.selectProfiles(pod); err == nil {
+		t.Error("expected error for an unknown profile")
+	}
+}
+
+func TestMutateAddsMissingLabels(t *testing.T) {
+	for _, kind := range []metav1.GroupVersionKind{
+		{Group: "apps", Version: "v1", Kind: "Deployment"},
+		{Group: "batch", Version: "v1", Kind: "Job"},
+	} {
+		workload := map[string]interface{}{
+			"apiVersion": kind.Group + "/" + kind.Version,
+			"kind":       kind.Kind,
+			"metadata": map[string]interface{}{
+				"name":   "sleep",
+				"labels": map[string]string{nameLabel: "sleep", versionLabel: "0.1"},
+			},
+			"spec": map[string]interface{}{
+				"template": map[string]interface{}{"metadata": map[string]interface{}{}},
+			},
+		}
+		raw, err := json.Marshal(workload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &admissionv1.AdmissionRequest{
+			Kind:      kind,
+			Namespace: "default",
+			Object:    runtime.RawExtension{Raw: raw},
+		}
+		patch := mutatePatch(t, &WebhookServer{}, req)
+
+		var metadataPaths []string
+		for _, p := range patch {
+			if p.Path == "/spec/template/metadata/labels" {
+				if labels := p.Value.(map[string]interface{}); len(labels) != len(requiredLabels) {
+					t.Errorf("%s: expected every label on the template, got %v", kind.Kind, labels)
+				}
+				continue
+			}
+			if p.Value != NA {
+				t.Errorf("%s: unexpected patch %v", kind.Kind, p)
+			}
+			metadataPaths = append(metadataPaths, p.Path)
+		}
+		want := []string{
+			"/metadata/labels/app.kubernetes.io~1component",
+			"/metadata/labels/app.kubernetes.io~1instance",
+			"/metadata/labels/app.kubernetes.io~1managed-by",
+			"/metadata/labels/app.kubernetes.io~1part-of",
+		}
+		if strings.Join(metadataPaths, ",") != strings.Join(want, ",") {
+			t.Errorf("%s: got %v, want %v", kind.Kind, metadataPaths, want)
+		}
+	}
+}
+
+func TestValidateRequiredLabels(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		metadata  map[string]interface{}
+		allowed   bool
+	}{
+		{
+			name:      "missing labels",
+			namespace: "default",
+			metadata:  map[string]interface{}{"name": "pi", "labels": map[string]string{nameLabel: "pi"}},
+		},
+		{
+			name:      "opt-out annotation",
+			namespace: "default",
+			metadata:  map[string]interface{}{"name": "pi", "annotations": map[string]string{admissionWebhookAnnotationValidateKey: "false"}},
+			allowed:   true,
+		},
+		{
+			name:      "ignored namespace",
+			namespace: metav1.NamespaceSystem,
+			metadata:  map[string]interface{}{"name": "pi"},
+			allowed:   true,
+		},
+	}
+	for _, test := range tests {
+		raw, err := json.Marshal(map[string]interface{}{"apiVersion": "batch/v1", "kind": "Job", "metadata": test.metadata})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := (&WebhookServer{}).validate(&admissionv1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"},
+			Namespace: test.namespace,
+			Object:    runtime.RawExtension{Raw: raw},
+		})
+		if resp.Allowed != test.allowed {
+			t.Errorf("%s: expected allowed=%v, got %v", test.name, test.allowed, resp.Result)
+		}
+		if !resp.Allowed && (len(resp.Result.Details.Causes) != len(requiredLabels)-1 || !strings.Contains(resp.Result.Message, partOfLabel)) {
+			t.Errorf("%s: expected the missing labels to be listed, got %v", test.name, resp.Result)
+		}
+	}
+}
+
+func TestValidatePodImages(t *testing.T) {
+	policy, err := loadPolicy("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	whsvr := &WebhookServer{}
+	whsvr.policy.Store(policy)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "app", Image: "nginx:1.19"},
+			{Name: "sidecar-nginx", Image: "socp.io/zk/sidecar:0407"},
+		}},
+	}
+	if resp := whsvr.validate(podRequest(t, pod)); !resp.Allowed {
+		t.Fatalf("expected tagged images to be allowed, got %v", resp.Result)
+	}
+
+	pod.Spec.Containers[1].Image = "socp.io/zk/sidecar"
+	resp := whsvr.validate(podRequest(t, pod))
+	if resp.Allowed || len(resp.Result.Details.Causes) != 1 || resp.Result.Details.Causes[0].Field != "spec.containers[1].image" {
+		t.Errorf("expected the untagged sidecar image to be rejected, got %v", resp.Result)
+	}
+
+	// the validate annotation cannot opt out of the policy
+	pod.Annotations = map[string]string{admissionWebhookAnnotationValidateKey: "false"}
+	pod.Spec.Containers[1].Image = "evil.io/x:latest"
+	if resp := whsvr.validate(podRequest(t, pod)); resp.Allowed {
+		t.Errorf("expected the latest tag to be rejected for an opted-out Pod")
+	}
+}
+
+func TestValidateApplicationReportsBadImageOnce(t *testing.T) {
+	policy, err := loadPolicy("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	whsvr := &WebhookServer{}
+	whsvr.policy.Store(policy)
+
+	app := validApplication()
+	app.Spec.Components[0].Containers[0].Image = "socp.io/Library/nginx:1.19"
+	raw, err := json.Marshal(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := whsvr.validate(&admissionv1.AdmissionRequest{
+		Kind:      metav1.GroupVersionKind{Group: "qikqiak.com", Version: "v1", Kind: "Application"},
+		Namespace: "default",
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	})
+	if resp.Allowed || len(resp.Result.Details.Causes) != 1 || resp.Result.Details.Causes[0].Field != "spec.components[0].containers[0].image" {
+		t.Errorf("expected a single cause for the invalid image, got %v", resp.Result)
+	}
+}